@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Line appended to the audit log for each retrieval, which never contains the password
+type auditRecord struct {
+	Time     string `json:"time"`
+	Command  string `json:"command"`
+	User     string `json:"user"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Dbname   string `json:"dbname"`
+	Provider string `json:"provider"`
+	// "found", "not_found", "error", or "cached"
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Returns the result of the retrieval from the provider recorded in the audit log
+func auditResult(cred credential, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case cred.password != "":
+		return "found"
+	default:
+		return "not_found"
+	}
+}
+
+// Appends the result of the retrieval to the file specified by PGW_AUDIT_LOG, if any
+func (w *wrapper) writeAuditLog(info conninfo.ConnInfo, provider string, result string, err error) {
+	var path = w.getenv("PGW_AUDIT_LOG")
+	if path == "" {
+		return
+	}
+	var record = auditRecord{
+		Time:     time.Now().Format(time.RFC3339),
+		Command:  w.command,
+		User:     info.User,
+		Host:     info.Host,
+		Port:     info.Port,
+		Dbname:   info.Dbname,
+		Provider: provider,
+		Result:   result,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		w.logger.warnf("%v", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		w.logger.warnf("failed to open the audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		w.logger.warnf("failed to write the audit log: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestAuditLogIsAppended(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var path = filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv("PGW_AUDIT_LOG", path)
+	var provider, _ = writeProvider(t, "if [ \"$1\" = alice ]; then echo s3cret; else exit 1; fi\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales"}
+	if _, err := w.retrievePasswordForUser(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+	info.User = "bob"
+	if _, err := w.retrievePasswordForUser(context.Background(), info); err == nil {
+		t.Fatal("provider failing for bob succeeded")
+	}
+
+	var data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Errorf("audit log contains the password: %q", data)
+	}
+	var lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d lines, want 2", len(lines))
+	}
+	var want = []auditRecord{
+		{Command: "psql", User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales", Provider: provider, Result: "found"},
+		{Command: "psql", User: "bob", Host: "db.example.com", Port: "5432", Dbname: "sales", Provider: provider, Result: "error"},
+	}
+	for i, line := range lines {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %d is invalid JSON: %v", i+1, err)
+		}
+		if record.Time == "" {
+			t.Errorf("line %d has no time", i+1)
+		}
+		if i == 1 && record.Error == "" {
+			t.Errorf("line %d has no error", i+1)
+		}
+		record.Time, record.Error = "", ""
+		if record != want[i] {
+			t.Errorf("line %d = %+v, want %+v", i+1, record, want[i])
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		if stat, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if stat.Mode().Perm() != 0600 {
+			t.Errorf("mode of the audit log = %04o, want 0600", stat.Mode().Perm())
+		}
+	}
+}
+
+func TestAuditLogRecordsCacheHits(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var path = filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv("PGW_AUDIT_LOG", path)
+	t.Setenv("PGW_CACHE_TTL", "1m")
+	var provider, _ = writeProvider(t, "echo s3cret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales"}
+	// Retrieved from the provider, then from the memory, and then from the disk by another invocation
+	for _, w := range []*wrapper{w, w, newWrapper("psqlw")} {
+		w.command = "psql"
+		if _, err := w.retrievePasswordForUser(context.Background(), info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON %q: %v", line, err)
+		}
+		if record.User != "alice" {
+			t.Errorf("user = %q, want alice", record.User)
+		}
+		results = append(results, record.Result+" "+record.Provider)
+	}
+	var want = []string{"found " + provider, "cached ", "cached "}
+	if strings.Join(results, ",") != strings.Join(want, ",") {
+		t.Errorf("results = %q, want %q", results, want)
+	}
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Name of the secret by default
+const defaultAWSSecretID = "psqlw/{host}/{user}"
+
+// Part of the client of AWS Secrets Manager used by the provider, which is replaced in the tests
+type secretsManagerClient interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// Retrieves the password from AWS Secrets Manager,
+// resolving the credentials and the region by the default chain of the SDK
+type awsSecretsProvider struct {
+	w *wrapper
+	// Created on the first lookup if nil
+	client secretsManagerClient
+}
+
+func newAWSSecretsProvider(w *wrapper) passwordProvider {
+	return &awsSecretsProvider{w: w}
+}
+
+func (p *awsSecretsProvider) name() string {
+	return "aws-secrets"
+}
+
+func (p *awsSecretsProvider) lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	var id = p.w.getenv("PGW_AWS_SECRET_ID")
+	if id == "" {
+		id = defaultAWSSecretID
+	}
+	id = placeholderReplacer(info, nil).Replace(id)
+
+	var timeout, err = p.w.getProviderTimeout()
+	if err != nil {
+		return credential{}, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	defer p.w.logProviderTime("aws-secrets", time.Now())
+
+	if p.client == nil {
+		var cfg, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return credential{}, fmt.Errorf("failed to load the configuration of AWS: %w", err)
+		}
+		p.client = secretsmanager.NewFromConfig(cfg)
+	}
+	output, err := p.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		return credential{}, errPasswordNotFound
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return credential{}, fmt.Errorf("AWS Secrets Manager timed out after %s", timeout)
+	case err != nil:
+		return credential{}, fmt.Errorf("failed to get the secret \"%s\" from AWS Secrets Manager: %w", id, err)
+	case output.SecretString == nil:
+		return credential{}, fmt.Errorf("secret \"%s\" in AWS Secrets Manager has no string but only binary", id)
+	}
+
+	// The secret is either the password itself or a JSON object like the one for RDS
+	var secret = strings.TrimSpace(*output.SecretString)
+	if !strings.HasPrefix(secret, "{") {
+		if secret == "" {
+			return credential{}, errPasswordNotFound
+		}
+		return credential{password: secret}, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return credential{}, fmt.Errorf("secret \"%s\" in AWS Secrets Manager is invalid JSON: %w", id, err)
+	}
+	cred, err := credentialFromFields(fields)
+	if err != nil && !errors.Is(err, errPasswordNotFound) {
+		return credential{}, fmt.Errorf("secret \"%s\" in AWS Secrets Manager %w", id, err)
+	}
+	return cred, err
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Client of AWS Secrets Manager returning the secret for the ID, or the error
+type mockSecretsManager struct {
+	secrets map[string]*secretsmanager.GetSecretValueOutput
+	err     error
+	ids     []string
+}
+
+func (m *mockSecretsManager) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	var id = aws.ToString(params.SecretId)
+	m.ids = append(m.ids, id)
+	if m.err != nil {
+		return nil, m.err
+	}
+	if output, found := m.secrets[id]; found {
+		return output, nil
+	}
+	return nil, &types.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}
+}
+
+func TestAWSSecretsProvider(t *testing.T) {
+	var secrets = map[string]*secretsmanager.GetSecretValueOutput{
+		"psqlw/db.example.com/alice": {SecretString: aws.String("secret\n")},
+		"rds/sales":                  {SecretString: aws.String(`{"username":"svc_sales","password":"secret","engine":"postgres"}`)},
+		"psqlw/db.example.com/bob":   {SecretString: aws.String("")},
+		"psqlw/db.example.com/carol": {SecretBinary: []byte("secret")},
+		"psqlw/db.example.com/dave":  {SecretString: aws.String(`{"password":`)},
+	}
+	var tests = []struct {
+		name     string
+		id       string
+		user     string
+		username string
+		password string
+		err      string
+	}{
+		{"plain", "", "alice", "", "secret", ""},
+		{"JSON", "rds/{dbname}", "alice", "svc_sales", "secret", ""},
+		{"not found", "", "eve", "", "", errPasswordNotFound.Error()},
+		{"empty", "", "bob", "", "", errPasswordNotFound.Error()},
+		{"binary", "", "carol", "", "", "secret \"psqlw/db.example.com/carol\" in AWS Secrets Manager has no string but only binary"},
+		{"invalid JSON", "", "dave", "", "", "secret \"psqlw/db.example.com/dave\" in AWS Secrets Manager is invalid JSON: unexpected end of JSON input"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			t.Setenv("PGW_AWS_SECRET_ID", test.id)
+			var client = &mockSecretsManager{secrets: secrets}
+			var p = &awsSecretsProvider{w: w, client: client}
+
+			var cred, err = p.lookup(context.Background(), conninfo.ConnInfo{User: test.user, Host: "db.example.com", Dbname: "sales"})
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("error = %v, want %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if cred.username != test.username || cred.password != test.password {
+				t.Errorf("credential = %q, %q, want %q, %q", cred.username, cred.password, test.username, test.password)
+			}
+			if len(client.ids) != 1 {
+				t.Errorf("secrets requested = %q, want one", client.ids)
+			}
+		})
+	}
+}
+
+func TestAWSSecretsProviderFailure(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var denied = errors.New("AccessDeniedException: not authorized")
+	var p = &awsSecretsProvider{w: w, client: &mockSecretsManager{err: denied}}
+	var _, err = p.lookup(context.Background(), conninfo.ConnInfo{User: "alice", Host: "db.example.com"})
+	if !errors.Is(err, denied) || errors.Is(err, errPasswordNotFound) {
+		t.Errorf("error = %v, want the error of the client", err)
+	}
+	if want := "failed to get the secret \"psqlw/db.example.com/alice\" from AWS Secrets Manager: AccessDeniedException: not authorized"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+}
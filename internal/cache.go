@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Credential stored in the cache file, which is readable only by the owner
+type cacheEntry struct {
+	// Unix times when the entry was stored and expires
+	Created  int64             `json:"created"`
+	Expires  int64             `json:"expires"`
+	Password string            `json:"password"`
+	Username string            `json:"username,omitempty"`
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// Returns the directory for the cache files, e.g. ~/.cache/psqlw
+func (w *wrapper) cacheDir() (string, error) {
+	var dir, err = os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, w.name), nil
+}
+
+// Returns the path of the cache file for the key, which is named by the hash of the key
+// and of the providers for the host, so that a password is never taken for another provider
+func (w *wrapper) cachePath(key passwordKey) (string, error) {
+	var dir, err = w.cacheDir()
+	if err != nil {
+		return "", err
+	}
+	var fields = []string{key.user, key.host, key.port, key.dbname, key.service}
+	fields = append(fields, w.providerIdentity(key.host)...)
+	var hash = sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return filepath.Join(dir, hex.EncodeToString(hash[:])+".json"), nil
+}
+
+// Returns the names of the providers for the host, and the settings telling them which secret to look up
+func (w *wrapper) providerIdentity(host string) []string {
+	var names []string
+	if providers, err := w.selectPasswordProviders(conninfo.ConnInfo{Host: host}); err == nil {
+		for _, provider := range providers {
+			names = append(names, provider.name())
+		}
+	}
+	for _, name := range []string{"PGW_PROVIDER_ARGS", "PGW_VAULT_PATH", "PGW_AWS_SECRET_ID", "PGW_SYSTEMD_CREDENTIAL"} {
+		names = append(names, w.getenv(name))
+	}
+	return names
+}
+
+func (w *wrapper) loadCachedCredential(key passwordKey, ttl time.Duration) (credential, bool) {
+	var path, err = w.cachePath(key)
+	if err != nil {
+		return credential{}, false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return credential{}, false
+	}
+	defer file.Close()
+	if runtime.GOOS != "windows" {
+		// Ignores the file which may have been read by others
+		if info, err := file.Stat(); err != nil || info.Mode().Perm()&0077 != 0 {
+			return credential{}, false
+		}
+	}
+	var entry cacheEntry
+	if err := json.NewDecoder(file).Decode(&entry); err != nil {
+		return credential{}, false
+	}
+	// Also rejects the entry stored in the future by the clock set back, or with a longer TTL than now
+	var now = time.Now().Unix()
+	if now < entry.Created || now >= entry.Expires || entry.Expires-entry.Created > int64(ttl.Seconds())+1 {
+		os.Remove(path)
+		return credential{}, false
+	}
+	return credential{password: entry.Password, username: entry.Username, settings: entry.Settings}, true
+}
+
+// Stores the credential atomically, so that concurrent invocations never read a partial file
+func (w *wrapper) storeCachedCredential(key passwordKey, cred credential, ttl time.Duration) {
+	var path, err = w.cachePath(key)
+	if err != nil {
+		w.logger.warnf("failed to cache the password: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		w.logger.warnf("failed to cache the password: %v", err)
+		return
+	}
+	var now = time.Now()
+	var entry = cacheEntry{
+		Created:  now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+		Password: cred.password,
+		Username: cred.username,
+		Settings: cred.settings,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		w.logger.warnf("failed to cache the password: %v", err)
+		return
+	}
+	// CreateTemp creates the file with mode 0600
+	file, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		w.logger.warnf("failed to cache the password: %v", err)
+		return
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		w.logger.warnf("failed to cache the password: %v", err)
+	}
+}
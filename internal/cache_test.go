@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Rewrites the times of the cached entry relative to now
+func rewriteCacheEntry(t *testing.T, path string, created time.Duration, expires time.Duration) {
+	t.Helper()
+	var data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	var now = time.Now()
+	entry.Created, entry.Expires = now.Add(created).Unix(), now.Add(expires).Unix()
+	if data, err = json.Marshal(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedCredential(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider, calls = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	t.Setenv("PGW_CACHE_TTL", "30s")
+
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales"}
+	var path, err = w.cachePath(passwordKeyFor(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Retrieves the password as a new invocation of the wrapper
+	var retrieve = func(info conninfo.ConnInfo) {
+		t.Helper()
+		w.credentials = make(map[passwordKey]credential)
+		var cred, err = w.retrievePasswordForUser(context.Background(), info)
+		if err != nil || cred.password != "secret" {
+			t.Fatalf("password = %q, %v, want %q", cred.password, err, "secret")
+		}
+	}
+	var steps = []struct {
+		name string
+		// Run before the retrieval
+		prepare func()
+		info    conninfo.ConnInfo
+		calls   int
+	}{
+		{"miss", func() {}, info, 1},
+		{"hit", func() {}, info, 1},
+		{"miss for another user", func() {}, conninfo.ConnInfo{User: "bob", Host: "db.example.com"}, 2},
+		{"expired", func() { rewriteCacheEntry(t, path, -time.Minute, -time.Second) }, info, 3},
+		{"hit after refreshed", func() {}, info, 3},
+		{"stored in the future", func() { rewriteCacheEntry(t, path, time.Hour, time.Hour+30*time.Second) }, info, 4},
+		{"longer TTL than now", func() { rewriteCacheEntry(t, path, 0, time.Hour) }, info, 5},
+	}
+	for _, step := range steps {
+		step.prepare()
+		retrieve(step.info)
+		if got := invocations(t, calls); len(got) != step.calls {
+			t.Errorf("%s: provider invoked %d times in total, want %d", step.name, len(got), step.calls)
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		if stat, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if stat.Mode().Perm() != 0600 {
+			t.Errorf("mode of the cache file = %04o, want 0600", stat.Mode().Perm())
+		}
+	}
+}
+
+func TestCacheIsDisabledByDefault(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider, _ = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var info = conninfo.ConnInfo{User: "alice"}
+	if _, err := w.retrievePasswordForUser(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+	var path, err = w.cachePath(passwordKeyFor(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cache file is written without PGW_CACHE_TTL: %v", err)
+	}
+}
+
+func TestCachedCredentialIsKeptByServiceAndProvider(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider, calls = writeProvider(t, "echo \"secret-$PGW_SERVICE\"\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	t.Setenv("PGW_CACHE_TTL", "30s")
+
+	// Retrieves the password as a new invocation of the wrapper
+	var retrieve = func(service string, want string) {
+		t.Helper()
+		w.credentials = make(map[passwordKey]credential)
+		var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Service: service}
+		var cred, err = w.retrievePasswordForUser(context.Background(), info)
+		if err != nil || cred.password != want {
+			t.Fatalf("password for service %q = %q, %v, want %q", service, cred.password, err, want)
+		}
+	}
+	retrieve("prod", "secret-prod")
+	retrieve("staging", "secret-staging")
+	retrieve("prod", "secret-prod")
+	if got := invocations(t, calls); len(got) != 2 {
+		t.Errorf("provider invoked %d times, want once for each service", len(got))
+	}
+
+	// Another provider does not take the password cached for the first one
+	var another, anotherCalls = writeProvider(t, "echo another\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", another)
+	retrieve("prod", "another")
+	if got := invocations(t, anotherCalls); len(got) != 1 {
+		t.Errorf("another provider invoked %d times, want 1", len(got))
+	}
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var commandPrefixes = []string{"psqlw-", "pgw-"}
+
+// Derives the command to wrap from the name by which the wrapper is invoked,
+// e.g. "pg_dumpw" or "pgw-pg_dump" for "pg_dump".
+// Returns an empty string if the name does not follow any pattern.
+func commandForName(name string) string {
+	if runtime.GOOS == "windows" {
+		if ext := ".exe"; len(name) > len(ext) && strings.EqualFold(name[len(name)-len(ext):], ext) {
+			name = name[:len(name)-len(ext)]
+		}
+	}
+	for _, prefix := range commandPrefixes {
+		if command, found := strings.CutPrefix(name, prefix); found && command != "" {
+			return command
+		}
+	}
+	if command, found := strings.CutSuffix(name, "w"); found && command != "" {
+		return command
+	}
+	return ""
+}
+
+// Returns the path of the executable for the command
+func (w *wrapper) resolveCommand(command string) (string, error) {
+	if command == "psql" {
+		if path := w.getenv("PGW_PSQL_PATH"); path != "" {
+			return path, nil
+		}
+	}
+	var path, err = exec.LookPath(command)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", fmt.Errorf("%s not found in PATH", command)
+		}
+		return "", err
+	}
+	return path, nil
+}
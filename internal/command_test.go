@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCommandForName(t *testing.T) {
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"psqlw", "psql"},
+		{"pg_dumpw", "pg_dump"},
+		{"pg_restorew", "pg_restore"},
+		{"psqlw-pg_dump", "pg_dump"},
+		{"pgw-vacuumdb", "vacuumdb"},
+		{"pgw-", ""},
+		{"w", ""},
+		{"wrapper", ""},
+		{"psql", ""},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, []struct {
+			name string
+			want string
+		}{
+			{"pg_dumpw.exe", "pg_dump"},
+			{"pgw-pg_dump.EXE", "pg_dump"},
+		}...)
+	}
+	for _, test := range tests {
+		if got := commandForName(test.name); got != test.want {
+			t.Errorf("commandForName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResolveCommandNotFound(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PATH", t.TempDir())
+	var _, err = w.resolveCommand("psql")
+	if err == nil || err.Error() != "psql not found in PATH" {
+		t.Errorf("error = %v, want \"psql not found in PATH\"", err)
+	}
+
+	// The path given explicitly is not looked up
+	t.Setenv("PGW_PSQL_PATH", "/opt/pgsql/bin/psql")
+	if path, err := w.resolveCommand("psql"); err != nil || path != "/opt/pgsql/bin/psql" {
+		t.Errorf("resolveCommand = %q, %v, want PGW_PSQL_PATH", path, err)
+	}
+	if _, err := w.resolveCommand("pg_dump"); err == nil {
+		t.Errorf("PGW_PSQL_PATH is taken for pg_dump")
+	}
+}
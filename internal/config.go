@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maps the keys in the config file to the environment variables they stand for
+var configKeys = map[string]string{
+	"password_provider":        "PGW_PASSWORD_PROVIDER",
+	"provider":                 "PGW_PROVIDER",
+	"vault_path":               "PGW_VAULT_PATH",
+	"aws_secret_id":            "PGW_AWS_SECRET_ID",
+	"systemd_credential":       "PGW_SYSTEMD_CREDENTIAL",
+	"provider_timeout":         "PGW_PROVIDER_TIMEOUT",
+	"provider_retries":         "PGW_PROVIDER_RETRIES",
+	"provider_args":            "PGW_PROVIDER_ARGS",
+	"provider_env_allow":       "PGW_PROVIDER_ENV_ALLOW",
+	"provider_socket":          "PGW_PROVIDER_SOCKET",
+	"provider_proto":           "PGW_PROVIDER_PROTO",
+	"provider_error_exit":      "PGW_PROVIDER_ERROR_EXIT",
+	"disable_default_provider": "PGW_DISABLE_DEFAULT_PROVIDER",
+	"log_level":                "PGW_LOG_LEVEL",
+	"log_format":               "PGW_LOG_FORMAT",
+	"quiet":                    "PGW_QUIET",
+	"audit_log":                "PGW_AUDIT_LOG",
+	"cache_ttl":                "PGW_CACHE_TTL",
+	"prefetch_users":           "PGW_PREFETCH_USERS",
+	"allow_empty_user":         "PGW_ALLOW_EMPTY_USER",
+	"no_osuser_fallback":       "PGW_NO_OSUSER_FALLBACK",
+	"user_option":              "PGW_USER_OPTION",
+	"strip_short_equals":       "PGW_STRIP_SHORT_EQUALS",
+	"use_passfile":             "PGW_USE_PASSFILE",
+	"unquote_password":         "PGW_UNQUOTE_PASSWORD",
+	"extra_args":               "PGW_EXTRA_ARGS",
+	"skip_users":               "PGW_SKIP_USERS",
+	"prompt_feed":              "PGW_PROMPT_FEED",
+	"default_provider_name":    "PGW_DEFAULT_PROVIDER_NAME",
+	"psql_path":                "PGW_PSQL_PATH",
+	"dry_run":                  "PGW_DRY_RUN",
+	"kill_grace":               "PGW_KILL_GRACE",
+	"debug":                    "PGW_DEBUG",
+}
+
+// Key in the config file prefixed to the host to map it to the provider for the host
+const hostProviderKey = "password_provider@"
+
+// Returns the name under which the provider for the host is held in the config
+func hostProviderName(host string) string {
+	return "PGW_PASSWORD_PROVIDER@" + strings.ToLower(host)
+}
+
+// Returns the providers for the host given in the config file,
+// or PGW_PASSWORD_PROVIDER if no providers are mapped to the host, along with where they come from
+func (w *wrapper) passwordProviderSetting(host string) (string, string) {
+	if host != "" {
+		if value := w.config[hostProviderName(host)]; value != "" {
+			return value, hostProviderKey + host
+		}
+	}
+	return w.getenv("PGW_PASSWORD_PROVIDER"), "PGW_PASSWORD_PROVIDER"
+}
+
+// Returns the value of the environment variable, or the one in the config file if unset
+func (w *wrapper) getenv(name string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return w.config[name]
+}
+
+// Returns the directories where the files for the wrapper are searched for, in order
+func (w *wrapper) configDirs() []string {
+	var dirs []string
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		dirs = append(dirs, filepath.Join(dir, w.name))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".config", w.name))
+	}
+	return dirs
+}
+
+// Loads the config file specified by PGW_CONFIG, or the first existing one in the config directories
+func (w *wrapper) loadConfig() error {
+	if path := os.Getenv("PGW_CONFIG"); path != "" {
+		var config, err = readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		w.config = config
+		return nil
+	}
+	for _, dir := range w.configDirs() {
+		var config, err = readConfigFile(filepath.Join(dir, "config"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		w.config = config
+		break
+	}
+	return nil
+}
+
+// Reads the lines of the form key=value, and returns the values by the environment variable names
+func readConfigFile(path string) (map[string]string, error) {
+	var file, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config = make(map[string]string)
+	var scanner = bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var key, value, found = strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("missing \"=\" at line %d of \"%s\"", lineNo, path)
+		}
+		key = strings.TrimSpace(key)
+		name, ok := configKeys[key]
+		if host, found := strings.CutPrefix(key, hostProviderKey); found && host != "" {
+			name, ok = hostProviderName(host), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown key \"%s\" at line %d of \"%s\"", key, lineNo, path)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+			value = value[1 : len(value)-1]
+		}
+		config[name] = value
+	}
+	return config, scanner.Err()
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes the config file, and returns its path
+func writeConfig(t *testing.T, dir string, content string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var path = filepath.Join(dir, "config")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	var path = writeConfig(t, t.TempDir(), `# provider for the team
+password_provider = /usr/local/bin/team-provider
+
+provider_timeout=30
+log_level = "debug"
+use_passfile=1
+`)
+	var config, err = readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = map[string]string{
+		"PGW_PASSWORD_PROVIDER": "/usr/local/bin/team-provider",
+		"PGW_PROVIDER_TIMEOUT":  "30",
+		"PGW_LOG_LEVEL":         "debug",
+		"PGW_USE_PASSFILE":      "1",
+	}
+	if len(config) != len(want) {
+		t.Errorf("config = %q, want %q", config, want)
+	}
+	for name, value := range want {
+		if config[name] != value {
+			t.Errorf("%s = %q, want %q", name, config[name], value)
+		}
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	var tests = []struct {
+		content string
+		want    string
+	}{
+		{"log_level=debug\nprovider\n", "missing \"=\" at line 2"},
+		{"password_providers=/bin/provider\n", "unknown key \"password_providers\" at line 1"},
+	}
+	for _, test := range tests {
+		var _, err = readConfigFile(writeConfig(t, t.TempDir(), test.content))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("error = %v, want %q", err, test.want)
+		}
+	}
+}
+
+func TestLoadConfigIsOverriddenByEnv(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	writeConfig(t, filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "psqlw"), "provider_retries=3\nprovider_timeout=30\n")
+	t.Setenv("PGW_PROVIDER_TIMEOUT", "5")
+
+	if err := w.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.getenv("PGW_PROVIDER_RETRIES"); got != "3" {
+		t.Errorf("PGW_PROVIDER_RETRIES = %q, want %q from the file", got, "3")
+	}
+	if got := w.getenv("PGW_PROVIDER_TIMEOUT"); got != "5" {
+		t.Errorf("PGW_PROVIDER_TIMEOUT = %q, want %q from the environment", got, "5")
+	}
+	// Even the empty variable overrides the file
+	t.Setenv("PGW_PROVIDER_RETRIES", "")
+	if got := w.getenv("PGW_PROVIDER_RETRIES"); got != "" {
+		t.Errorf("PGW_PROVIDER_RETRIES = %q, want empty from the environment", got)
+	}
+}
+
+func TestLoadConfigForCommandSettings(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	writeConfig(t, filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "psqlw"),
+		"skip_users=postgres\npsql_path=/opt/pgsql/bin/psql\ndefault_provider_name=team-provider\nkill_grace=2s\n")
+
+	if err := w.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.isSkippedUser("postgres") {
+		t.Errorf("user in skip_users is not skipped")
+	}
+	if path, err := w.resolveCommand("psql"); err != nil || path != "/opt/pgsql/bin/psql" {
+		t.Errorf("resolveCommand = %q, %v, want psql_path", path, err)
+	}
+	if got := filepath.Base(w.defaultPasswordProviderPaths()[0]); got != "team-provider" {
+		t.Errorf("default provider = %q, want default_provider_name", got)
+	}
+	if got, err := w.getDuration("PGW_KILL_GRACE", defaultKillGrace); err != nil || got != 2*time.Second {
+		t.Errorf("PGW_KILL_GRACE = %v, %v, want kill_grace", got, err)
+	}
+}
+
+func TestLoadConfigFromPGW_CONFIG(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	writeConfig(t, filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "psqlw"), "log_level=info\n")
+	t.Setenv("PGW_CONFIG", writeConfig(t, t.TempDir(), "log_level=debug\n"))
+
+	if err := w.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.getenv("PGW_LOG_LEVEL"); got != "debug" {
+		t.Errorf("PGW_LOG_LEVEL = %q, want %q from PGW_CONFIG", got, "debug")
+	}
+
+	t.Setenv("PGW_CONFIG", filepath.Join(t.TempDir(), "missing"))
+	if err := w.loadConfig(); err == nil {
+		t.Errorf("missing PGW_CONFIG is accepted")
+	}
+}
+
+func TestPasswordProviderForHost(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_CONFIG", writeConfig(t, t.TempDir(), `password_provider=/usr/local/bin/file-provider
+password_provider@prod.db=/usr/local/bin/vault-provider
+password_provider@db1,db2=/usr/local/bin/cluster-provider
+`))
+	if err := w.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		host   string
+		env    string
+		want   string
+		origin string
+	}{
+		{"prod.db", "", "/usr/local/bin/vault-provider", "password_provider@prod.db"},
+		{"PROD.DB", "", "/usr/local/bin/vault-provider", "password_provider@PROD.DB"},
+		{"db1,db2", "", "/usr/local/bin/cluster-provider", "password_provider@db1,db2"},
+		{"dev.db", "", "/usr/local/bin/file-provider", "PGW_PASSWORD_PROVIDER"},
+		{"", "", "/usr/local/bin/file-provider", "PGW_PASSWORD_PROVIDER"},
+		// The environment replaces only the global one
+		{"dev.db", "/opt/bin/provider", "/opt/bin/provider", "PGW_PASSWORD_PROVIDER"},
+		{"prod.db", "/opt/bin/provider", "/usr/local/bin/vault-provider", "password_provider@prod.db"},
+	}
+	for _, test := range tests {
+		if test.env != "" {
+			t.Setenv("PGW_PASSWORD_PROVIDER", test.env)
+		} else {
+			os.Unsetenv("PGW_PASSWORD_PROVIDER")
+		}
+		var providers, err = w.getPasswordProviders(test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 1 || providers[0] != test.want {
+			t.Errorf("providers for %q = %q, want %q", test.host, providers, test.want)
+		}
+		if _, origin := w.passwordProviderSetting(test.host); origin != test.origin {
+			t.Errorf("origin for %q = %q, want %q", test.host, origin, test.origin)
+		}
+	}
+}
+
+func TestBuildEnvWithProviderForHost(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var global, globalCalls = writeProvider(t, "echo global\n")
+	var prod, prodCalls = writeProvider(t, "echo prod\n")
+	t.Setenv("PGW_CONFIG", writeConfig(t, t.TempDir(), "password_provider="+global+"\npassword_provider@prod.db="+prod+"\n"))
+	if err := w.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"prod.db", "dev.db"} {
+		var env, err = w.buildEnv(context.Background(), []string{"-h", host, "-U", "alice", "sales"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want = map[string]string{"prod.db": "prod", "dev.db": "global"}[host]
+		if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != want {
+			t.Errorf("PGPASSWORD for %s = %q, want %q", host, got, want)
+		}
+	}
+	if len(invocations(t, globalCalls)) != 1 || len(invocations(t, prodCalls)) != 1 {
+		t.Errorf("providers invoked %q and %q, want once each", invocations(t, globalCalls), invocations(t, prodCalls))
+	}
+}
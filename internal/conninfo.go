@@ -0,0 +1,23 @@
+package internal
+
+import "github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+
+// Identifies a password retrieved from the provider
+type passwordKey struct {
+	user   string
+	host   string
+	port   string
+	dbname string
+	// The service may give the other parameters to the provider, e.g. PGUSER in the service file
+	service string
+}
+
+func passwordKeyFor(info conninfo.ConnInfo) passwordKey {
+	return passwordKey{
+		user:    info.User,
+		host:    info.Host,
+		port:    info.Port,
+		dbname:  info.Dbname,
+		service: info.Service,
+	}
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Credential returned by the password provider
+type credential struct {
+	password string
+	// Username for the password, which may differ from the one given to the provider
+	username string
+	// Connection parameters given along with the password, keyed by environment variable
+	settings map[string]string
+}
+
+// Environment variables for the connection parameters the provider may return
+var settingEnvVars = map[string]string{
+	"application_name":     "PGAPPNAME",
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"options":              "PGOPTIONS",
+	"sslcert":              "PGSSLCERT",
+	"sslkey":               "PGSSLKEY",
+	"sslmode":              "PGSSLMODE",
+	"sslrootcert":          "PGSSLROOTCERT",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+}
+
+// Parses the output of the provider, which is either the password in plain text
+// or a JSON object like below:
+//
+//	{
+//	  "username": "alice",
+//	  "password": "secret",
+//	  "sslmode": "require",
+//	  "options": "-c statement_timeout=5000"
+//	}
+//
+// The members other than "username" and "password" are the connection parameters listed in settingEnvVars,
+// and their values are strings, numbers or booleans. Unknown members are ignored.
+func (w *wrapper) parseProviderOutput(provider string, output []byte) (credential, error) {
+	// Some scripts on Windows write the byte order mark
+	output = bytes.TrimPrefix(output, []byte("\ufeff"))
+	if !bytes.HasPrefix(bytes.TrimLeft(output, " \t\r\n"), []byte("{")) {
+		return credential{password: parsePlainPassword(string(output), w.getenv("PGW_UNQUOTE_PASSWORD") == "1")}, nil
+	}
+
+	var members map[string]any
+	if err := json.Unmarshal(output, &members); err != nil {
+		return credential{}, fmt.Errorf("password provider \"%s\" returned invalid JSON: %w", provider, err)
+	}
+
+	var cred = credential{settings: make(map[string]string)}
+	for name, member := range members {
+		var value string
+		switch member := member.(type) {
+		case string:
+			value = member
+		case float64:
+			value = strconv.FormatFloat(member, 'f', -1, 64)
+		case bool:
+			value = strconv.FormatBool(member)
+		default:
+			return credential{}, fmt.Errorf("password provider \"%s\" returned invalid value for \"%s\"", provider, name)
+		}
+		if name == "password" {
+			cred.password = value
+		} else if name == "username" {
+			cred.username = value
+		} else if envVar, found := settingEnvVars[name]; found {
+			cred.settings[envVar] = value
+		} else {
+			w.logger.warnf("unknown parameter \"%s\" returned by password provider \"%s\" ignored", name, provider)
+		}
+	}
+	return cred, nil
+}
+
+// Reads the password preceded by its length as 4-byte big-endian integer,
+// which may contain any bytes including newlines. Writing nothing means no password.
+func parseLengthPrefixedOutput(provider string, output []byte) (credential, error) {
+	if len(output) == 0 {
+		return credential{}, nil
+	}
+	if len(output) < 4 {
+		return credential{}, fmt.Errorf("password provider \"%s\" returned a truncated length", provider)
+	}
+	var length = binary.BigEndian.Uint32(output)
+	if uint64(len(output)-4) != uint64(length) {
+		return credential{}, fmt.Errorf("password provider \"%s\" returned %d bytes for the length %d", provider, len(output)-4, length)
+	}
+	return credential{password: string(output[4:])}, nil
+}
+
+// Reads the lines of the form KEY=VALUE like below, in which PGPASSWORD gives the password
+// and PGUSER the username. The other variables are passed to the command as the settings.
+//
+//	PGPASSWORD=secret
+//	PGSSLMODE=require
+//
+// Only the variables of libpq starting with PG are accepted, and the others are ignored with a warning.
+func (w *wrapper) parseEnvOutput(provider string, output []byte) (credential, error) {
+	var cred = credential{settings: make(map[string]string)}
+	for i, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var name, value, found = strings.Cut(line, "=")
+		if !found {
+			return credential{}, fmt.Errorf("password provider \"%s\" returned invalid line %d without \"=\"", provider, i+1)
+		}
+		switch {
+		case name == "PGPASSWORD":
+			cred.password = value
+		case name == "PGUSER":
+			cred.username = value
+		case strings.HasPrefix(name, "PG") && !strings.HasPrefix(name, "PGW_"):
+			cred.settings[name] = value
+		default:
+			w.logger.warnf("variable \"%s\" returned by password provider \"%s\" ignored", name, provider)
+		}
+	}
+	return cred, nil
+}
+
+// Removes the surrounding spaces including CRLF written by batch files,
+// and unquotes the password quoted to keep its leading or trailing spaces, e.g. " secret ", if requested.
+// Nothing like a comment is removed, as the password may contain "#".
+func parsePlainPassword(output string, unquote bool) string {
+	var password = strings.TrimSpace(output)
+	if !unquote {
+		return password
+	}
+	if len(password) >= 2 && password[0] == '"' && password[len(password)-1] == '"' {
+		if unquoted, err := strconv.Unquote(password); err == nil {
+			return unquoted
+		}
+	}
+	if len(password) >= 2 && password[0] == '\'' && password[len(password)-1] == '\'' {
+		return password[1 : len(password)-1]
+	}
+	return password
+}
+
+// Appends the settings to the environment unless they are already set by the user.
+// The options are merged instead, with those of the user placed last to take precedence.
+func appendSettings(env []string, settings map[string]string) []string {
+	var names = make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var value, existing = settings[name], os.Getenv(name)
+		if name == "PGOPTIONS" && existing != "" && value != "" {
+			env = append(env, fmt.Sprintf("%s=%s %s", name, value, existing))
+		} else if existing == "" {
+			env = append(env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	return env
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestParseProviderOutputTrimsLineEndings(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	for _, output := range []string{"secret\r\n", "secret\n", "secret", "secret\r\n\r\n"} {
+		var cred, err = w.parseProviderOutput("provider", []byte(output))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.password != "secret" {
+			t.Errorf("password of %q = %q, want %q", output, cred.password, "secret")
+		}
+	}
+}
+
+func TestParseProviderOutputAsPlainPassword(t *testing.T) {
+	var tests = []struct {
+		output   string
+		unquote  string
+		password string
+	}{
+		{"\ufeffsecret\r\n", "", "secret"},
+		{"\ufeff secret \n", "", "secret"},
+		{"  secret\t\n", "", "secret"},
+		{"se cret\n", "", "se cret"},
+		// Not taken as a comment
+		{"secret # rotated\n", "", "secret # rotated"},
+		{"\" secret \"\n", "", "\" secret \""},
+		{"\" secret \"\n", "1", " secret "},
+		{"\"tab\\tquote\\\"\"\n", "1", "tab\tquote\""},
+		{"\ufeff' secret '\r\n", "1", " secret "},
+		{"'it''s'\n", "1", "it''s"},
+		// Kept as is unless quoted properly
+		{"\"unterminated\\\"\n", "1", "\"unterminated\\\""},
+		{"\"\n", "1", "\""},
+		{"'secret\"\n", "1", "'secret\""},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		t.Setenv("PGW_UNQUOTE_PASSWORD", test.unquote)
+		var cred, err = w.parseProviderOutput("provider", []byte(test.output))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.password != test.password {
+			t.Errorf("password of %q = %q, want %q", test.output, cred.password, test.password)
+		}
+	}
+}
+
+func TestAppendSettings(t *testing.T) {
+	var tests = []struct {
+		name     string
+		existing map[string]string
+		settings map[string]string
+		want     []string
+	}{
+		{"options without PGOPTIONS", nil, map[string]string{"PGOPTIONS": "-c statement_timeout=5000"},
+			[]string{"PGOPTIONS=-c statement_timeout=5000"}},
+		// Those of the user are placed last to take precedence
+		{"options merged with PGOPTIONS", map[string]string{"PGOPTIONS": "-c statement_timeout=0"}, map[string]string{"PGOPTIONS": "-c statement_timeout=5000"},
+			[]string{"PGOPTIONS=-c statement_timeout=5000 -c statement_timeout=0"}},
+		{"empty options", map[string]string{"PGOPTIONS": "-c statement_timeout=0"}, map[string]string{"PGOPTIONS": ""}, nil},
+		{"others kept", map[string]string{"PGSSLMODE": "disable"}, map[string]string{"PGSSLMODE": "require", "PGAPPNAME": "report"},
+			[]string{"PGAPPNAME=report"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range test.existing {
+				t.Setenv(name, value)
+			}
+			var got = appendSettings([]string{"HOME=/home/alice"}, test.settings)
+			if strings.Join(got[1:], "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("env = %q, want %q added", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildEnvMergesOptions(t *testing.T) {
+	for _, existing := range []string{"", "-c search_path=app"} {
+		var w, _ = newTestWrapper(t)
+		var provider, _ = writeProvider(t, `echo '{"password": "secret", "options": "-c statement_timeout=5000"}'`+"\n")
+		t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+		t.Setenv("PGOPTIONS", existing)
+
+		var env, err = w.buildEnv(context.Background(), []string{"-U", "alice", "sales"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want = strings.TrimSpace("-c statement_timeout=5000 " + existing)
+		if got := lookupEnv(env, "PGOPTIONS"); len(got) != 1 || got[0] != want {
+			t.Errorf("PGOPTIONS with %q = %q, want %q", existing, got, want)
+		}
+	}
+}
+
+func TestParseLengthPrefixedOutput(t *testing.T) {
+	var tests = []struct {
+		output   string
+		password string
+		err      string
+	}{
+		{"\x00\x00\x00\x06secret", "secret", ""},
+		{"\x00\x00\x00\x07secret\n", "secret\n", ""},
+		{"\x00\x00\x00\x09sec\nret\r\n", "sec\nret\r\n", ""},
+		{"\x00\x00\x00\x08 secret ", " secret ", ""},
+		{"\x00\x00\x00\x00", "", ""},
+		{"", "", ""},
+		{"\x00\x00\x06", "", "password provider \"provider\" returned a truncated length"},
+		{"\x00\x00\x00\x07secret", "", "password provider \"provider\" returned 6 bytes for the length 7"},
+		{"\x00\x00\x00\x06secret\n", "", "password provider \"provider\" returned 7 bytes for the length 6"},
+	}
+	for _, test := range tests {
+		var cred, err = parseLengthPrefixedOutput("provider", []byte(test.output))
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("error of %q = %v, want %q", test.output, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.password != test.password {
+			t.Errorf("password of %q = %q, want %q", test.output, cred.password, test.password)
+		}
+	}
+}
+
+func TestInvokePasswordProviderWithLengthPrefix(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_PROVIDER_PROTO", "length")
+	var provider, _ = writeProvider(t, `printf '\000\000\000\012sec\nret\n\n\n'`+"\n")
+
+	var cred, err = w.invokePasswordProvider(context.Background(), provider, conninfo.ConnInfo{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.password != "sec\nret\n\n\n" {
+		t.Errorf("password = %q, want the newlines kept", cred.password)
+	}
+}
+
+func TestParseEnvOutput(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	w.logger.level = levelWarn
+	var cred, err = w.parseEnvOutput("provider", []byte("PGPASSWORD=s=cret\r\nPGUSER=svc_sales\n\nPGSSLMODE=require\nPGOPTIONS=-c a=b\nLD_PRELOAD=/tmp/evil.so\nPGW_PASSWORD_PROVIDER=/tmp/evil\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.password != "s=cret" || cred.username != "svc_sales" {
+		t.Errorf("credential = %q, %q, want %q, %q", cred.username, cred.password, "svc_sales", "s=cret")
+	}
+	if len(cred.settings) != 2 || cred.settings["PGSSLMODE"] != "require" || cred.settings["PGOPTIONS"] != "-c a=b" {
+		t.Errorf("settings = %q, want PGSSLMODE and PGOPTIONS only", cred.settings)
+	}
+	for _, name := range []string{"LD_PRELOAD", "PGW_PASSWORD_PROVIDER"} {
+		if want := "variable \"" + name + "\" returned by password provider \"provider\" ignored"; !strings.Contains(out.String(), want) {
+			t.Errorf("log = %q, want %q", out.String(), want)
+		}
+	}
+
+	if _, err := w.parseEnvOutput("provider", []byte("PGPASSWORD=secret\nrequire\n")); err == nil ||
+		err.Error() != "password provider \"provider\" returned invalid line 2 without \"=\"" {
+		t.Errorf("error = %v, want the invalid line", err)
+	}
+}
+
+func TestBuildEnvWithEnvOutput(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_PROVIDER_PROTO", "env")
+	var provider, _ = writeProvider(t, "echo PGPASSWORD=secret\necho PGSSLMODE=require\necho LD_PRELOAD=/tmp/evil.so\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var env, err = w.buildEnv(context.Background(), []string{"-U", "alice", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != "secret" {
+		t.Errorf("PGPASSWORD = %q, want %q", got, "secret")
+	}
+	if got := lookupEnv(env, "PGSSLMODE"); len(got) != 1 || got[0] != "require" {
+		t.Errorf("PGSSLMODE = %q, want %q", got, "require")
+	}
+	if got := lookupEnv(env, "LD_PRELOAD"); len(got) != 0 {
+		t.Errorf("LD_PRELOAD = %q, want none", got)
+	}
+}
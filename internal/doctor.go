@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// Prints the diagnostics of the setup without running the provider nor the command,
+// and returns a non-zero exit code if any of the critical checks fails
+func (w *wrapper) runDoctor(command string, args []string) int {
+	var failed bool
+	var report = func(ok bool, format string, v ...any) {
+		var status = "ok  "
+		if !ok {
+			status = "FAIL"
+			failed = true
+		}
+		fmt.Printf("%s %s\n", status, fmt.Sprintf(format, v...))
+	}
+
+	if path, err := w.resolveCommand(command); err != nil {
+		report(false, "command: %v", err)
+	} else {
+		report(true, "command: %s", path)
+	}
+
+	var info, sources, _ = w.searchForConnInfo(args)
+	// The providers are checked in the same order as they are selected
+	var providers, err = w.selectPasswordProviders(info)
+	if errors.Is(err, errNoPasswordProvider) {
+		report(false, "provider: none found in %q, and PGW_PASSWORD_PROVIDER is undefined", w.defaultPasswordProviderPaths())
+	} else if err != nil {
+		report(false, "provider: %v", err)
+	}
+	for _, provider := range providers {
+		switch p := provider.(type) {
+		case *execProvider:
+			var origin = "default"
+			if setting, from := w.passwordProviderSetting(info.Host); setting != "" {
+				origin = from
+			}
+			if err := checkProviderFile(p.path); err != nil {
+				report(false, "provider: %v", err)
+			} else {
+				report(true, "provider: %s (%s)", p.path, origin)
+			}
+		case *socketProvider:
+			report(true, "provider: daemon at \"%s\" (PGW_PROVIDER_SOCKET)", p.path)
+		default:
+			report(true, "provider: %s (PGW_PROVIDER)", p.name())
+		}
+	}
+
+	fmt.Printf("info %s\n", describeConnInfo(info, sources))
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// Returns an error unless the provider is an existing executable
+func checkProviderFile(provider string) error {
+	if err := checkExecutable(provider); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath(provider); err != nil {
+		return fmt.Errorf("password provider \"%s\" is not found: %w", provider, err)
+	}
+	return nil
+}
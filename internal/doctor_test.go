@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the doctor, and returns its exit code and report
+func runDoctorForTest(t *testing.T, w *wrapper, args ...string) (int, string) {
+	t.Helper()
+	var code int
+	var report = captureStdout(t, func() {
+		code = w.runDoctor("psql", args)
+	})
+	return code, report
+}
+
+func TestDoctorReportsProvider(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var psql = writeScript(t, t.TempDir(), "psql", "exit 0\n")
+	t.Setenv("PGW_PSQL_PATH", psql)
+	var provider, calls = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var code, report = runDoctorForTest(t, w, "-U", "alice", "sales")
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0 for\n%s", code, report)
+	}
+	for _, want := range []string{
+		"ok   command: " + psql + "\n",
+		"ok   provider: " + provider + " (PGW_PASSWORD_PROVIDER)\n",
+		"info user \"alice\" (arg)",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+	if got := invocations(t, calls); len(got) != 0 {
+		t.Errorf("provider invoked %d times, want never", len(got))
+	}
+}
+
+func TestDoctorReportsDefaultProvider(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_PSQL_PATH", writeScript(t, t.TempDir(), "psql", "exit 0\n"))
+	var provider = writeScript(t, filepath.Dir(w.path), defaultPasswordProvider, "echo secret\n")
+
+	var code, report = runDoctorForTest(t, w, "sales")
+	if code != 0 || !strings.Contains(report, "ok   provider: "+provider+" (default)\n") {
+		t.Errorf("exit code = %d, want 0 and the default provider in\n%s", code, report)
+	}
+}
+
+func TestDoctorReportsMissingProvider(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_PSQL_PATH", writeScript(t, t.TempDir(), "psql", "exit 0\n"))
+
+	var code, report = runDoctorForTest(t, w, "sales")
+	if code != 1 || !strings.Contains(report, "FAIL provider: ") {
+		t.Errorf("exit code = %d, want 1 and the missing provider in\n%s", code, report)
+	}
+
+	// Also reported for the provider which does not exist
+	t.Setenv("PGW_PASSWORD_PROVIDER", filepath.Join(t.TempDir(), "missing"))
+	code, report = runDoctorForTest(t, w, "sales")
+	if code != 1 || !strings.Contains(report, "FAIL provider: ") {
+		t.Errorf("exit code = %d, want 1 and the missing provider in\n%s", code, report)
+	}
+}
+
+func TestDoctorReportsMissingCommand(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PATH", t.TempDir())
+	var provider, _ = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var code, report = runDoctorForTest(t, w, "sales")
+	if code != 1 || !strings.Contains(report, "FAIL command: psql not found in PATH\n") {
+		t.Errorf("exit code = %d, want 1 and the missing command in\n%s", code, report)
+	}
+}
+
+func TestDoctorReportsSelectedProvider(t *testing.T) {
+	var tests = []struct {
+		name   string
+		env    map[string]string
+		code   int
+		report string
+	}{
+		{"built-in", map[string]string{"PGW_PROVIDER": "systemd-creds"}, 0, "ok   provider: systemd-creds (PGW_PROVIDER)\n"},
+		{"built-in over socket", map[string]string{"PGW_PROVIDER": "vault", "PGW_PROVIDER_SOCKET": "/run/psqlw.sock"}, 0, "ok   provider: vault (PGW_PROVIDER)\n"},
+		{"socket", map[string]string{"PGW_PROVIDER_SOCKET": "/run/psqlw.sock"}, 0, "ok   provider: daemon at \"/run/psqlw.sock\" (PGW_PROVIDER_SOCKET)\n"},
+		{"unknown", map[string]string{"PGW_PROVIDER": "lastpass"}, 1, "FAIL provider: unknown password provider \"lastpass\" in PGW_PROVIDER\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			t.Setenv("PGW_PSQL_PATH", writeScript(t, t.TempDir(), "psql", "exit 0\n"))
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			var code, report = runDoctorForTest(t, w, "sales")
+			if code != test.code || !strings.Contains(report, test.report) {
+				t.Errorf("exit code = %d, want %d and %q in\n%s", code, test.code, test.report, report)
+			}
+		})
+	}
+}
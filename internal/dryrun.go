@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"os"
+	"strings"
+)
+
+// Prints the command and the environment variables added for it
+func (w *wrapper) printCommand(command string, args []string, env []string) {
+	w.logger.printf("command: %s", quoteCommandLine(append([]string{command}, args...)))
+	for _, entry := range addedEnv(os.Environ(), env) {
+		w.logger.printf("env: %s", maskPassword(entry))
+	}
+}
+
+// Returns the entries of env which are not in base
+func addedEnv(base []string, env []string) []string {
+	var existing = make(map[string]bool, len(base))
+	for _, entry := range base {
+		existing[entry] = true
+	}
+	var added []string
+	for _, entry := range env {
+		if !existing[entry] {
+			added = append(added, entry)
+		}
+	}
+	return added
+}
+
+// Returns the command line to be pasted into a POSIX shell,
+// preceded by the assignments of the environment variables added for it
+func echoCommandLine(command string, args []string, env []string) string {
+	var words []string
+	for _, entry := range addedEnv(os.Environ(), env) {
+		var name, value, _ = strings.Cut(maskPassword(entry), "=")
+		words = append(words, name+"="+quoteShellWord(value))
+	}
+	for _, arg := range append([]string{command}, args...) {
+		words = append(words, quoteShellWord(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+func maskPassword(entry string) string {
+	if name, _, _ := strings.Cut(entry, "="); name == "PGPASSWORD" {
+		return name + "=***"
+	}
+	return entry
+}
+
+// Quotes the arguments as needed to be pasted into a POSIX shell
+func quoteCommandLine(args []string) string {
+	var quoted = make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteShellWord(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func quoteShellWord(word string) string {
+	if word != "" && strings.IndexFunc(word, needsQuote) < 0 {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+func needsQuote(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return false
+	case strings.ContainsRune("-_./:=@%+,", r):
+		return false
+	}
+	return true
+}
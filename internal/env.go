@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"runtime"
+	"strings"
+)
+
+// Removes the duplicate variables from the environment, keeping the last value of each,
+// so that the variables added by the wrapper replace those inherited on every platform.
+// The order of the first occurrences is preserved.
+func dedupEnv(env []string) []string {
+	var values = make(map[string]string, len(env))
+	var names = make([]string, 0, len(env))
+	for _, entry := range env {
+		var name, _, _ = strings.Cut(entry, "=")
+		var key = envKey(name)
+		if _, found := values[key]; !found {
+			names = append(names, key)
+		}
+		values[key] = entry
+	}
+	var deduped = make([]string, len(names))
+	for i, key := range names {
+		deduped[i] = values[key]
+	}
+	return deduped
+}
+
+// Names of the environment variables are case-insensitive on Windows
+func envKey(name string) string {
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(name)
+	}
+	return name
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDedupEnv(t *testing.T) {
+	var tests = []struct {
+		env  []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{"A=1", "B=2"}, []string{"A=1", "B=2"}},
+		{[]string{"PGPASSWORD=old", "HOME=/home/alice", "PGPASSWORD=new"}, []string{"PGPASSWORD=new", "HOME=/home/alice"}},
+		{[]string{"A=1", "A=", "A=3"}, []string{"A=3"}},
+		// Only the first "=" separates the name
+		{[]string{"PGOPTIONS=-c a=b", "PGOPTIONS=-c c=d"}, []string{"PGOPTIONS=-c c=d"}},
+		{[]string{"=C:=C:\\", "A=1"}, []string{"=C:=C:\\", "A=1"}},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, struct {
+			env  []string
+			want []string
+		}{[]string{"Path=C:\\Windows", "PATH=C:\\bin"}, []string{"PATH=C:\\bin"}})
+	} else {
+		tests = append(tests, struct {
+			env  []string
+			want []string
+		}{[]string{"Path=/usr/bin", "PATH=/bin"}, []string{"Path=/usr/bin", "PATH=/bin"}})
+	}
+	for _, test := range tests {
+		if got := dedupEnv(test.env); strings.Join(got, "\n") != strings.Join(test.want, "\n") || len(got) != len(test.want) {
+			t.Errorf("dedupEnv(%q) = %q, want %q", test.env, got, test.want)
+		}
+	}
+}
+
+func TestBuildEnvHasSinglePGPASSWORD(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider, _ = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	// Empty, so replaced by the one from the provider
+	t.Setenv("PGPASSWORD", "")
+
+	var env, err = w.buildEnv(context.Background(), []string{"-U", "alice", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, entry := range env {
+		if strings.HasPrefix(entry, "PGPASSWORD=") {
+			found = append(found, entry)
+		}
+	}
+	if len(found) != 1 || found[0] != "PGPASSWORD=secret" {
+		t.Errorf("PGPASSWORD in the environment = %q, want exactly one", found)
+	}
+}
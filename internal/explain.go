@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Prints how each argument is classified by the parser, followed by the detected parameters,
+// without running the provider nor the command
+func (w *wrapper) runExplain(args []string) {
+	var parser = w.newParser(&passwordOptions{})
+	// The warnings are reported by searchForConnInfo below
+	parser.OnWarning = nil
+	parser.OnArgument = func(arg string, kind conninfo.ArgKind) {
+		fmt.Printf("%-12s %s\n", kind, quoteShellWord(arg))
+	}
+	parser.ParseWithSources(args)
+
+	var info, sources, _ = w.searchForConnInfo(args)
+	fmt.Printf("%-12s %s\n", "detected", describeConnInfo(info, sources))
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prefix of the options for the wrapper itself, which are not passed to the command
+const wrapperFlagPrefix = "--psqlw-"
+
+// Options for the wrapper itself
+type wrapperFlags struct {
+	// Prints the command without running it
+	dryRun bool
+	// Prints the command before running it
+	echo bool
+	// Username to test the provider for, instead of running the command
+	checkProvider string
+	// Prints the time taken by the provider
+	timing bool
+	// Prints the version of the wrapper
+	version bool
+	// Prints the diagnostics of the setup
+	doctor bool
+	// Prints the detected username
+	printUser bool
+	// Prints how the arguments are classified
+	explain bool
+}
+
+// Short options of the connection parameters, which take the values in all the commands
+const connectionShortOptions = "dhpU"
+
+// Finds the short options of the connection parameters written like "-U=alice",
+// which psql takes as the user "=alice". They are rewritten into "-Ualice" if strip is true,
+// or noticed even at the default log level otherwise.
+func (w *wrapper) checkShortEquals(args []string, strip bool) []string {
+	var checked = make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(checked, args[i:]...)
+		}
+		if len(arg) >= 3 && arg[0] == '-' && strings.IndexByte(connectionShortOptions, arg[1]) >= 0 && arg[2] == '=' {
+			if strip {
+				w.logger.debugf("option \"%s\" is rewritten as \"%s\"", arg, arg[:2]+arg[3:])
+				arg = arg[:2] + arg[3:]
+			} else {
+				w.logger.noticef("value of option \"%s\" is \"%s\" including \"=\", as psql takes it literally; set PGW_STRIP_SHORT_EQUALS to 1 to remove \"=\"",
+					arg[:2], arg[2:])
+			}
+		}
+		checked = append(checked, arg)
+	}
+	return checked
+}
+
+// Removes the options for the wrapper from the arguments
+func extractWrapperFlags(args []string) (wrapperFlags, []string, error) {
+	var flags wrapperFlags
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		var arg = args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, wrapperFlagPrefix) {
+			rest = append(rest, arg)
+			continue
+		}
+		var name, value, hasValue = strings.Cut(arg[len(wrapperFlagPrefix):], "=")
+		switch name {
+		case "dry-run":
+			flags.dryRun = true
+		case "echo":
+			flags.echo = true
+		case "timing":
+			flags.timing = true
+		case "version":
+			flags.version = true
+		case "doctor":
+			flags.doctor = true
+		case "print-user":
+			flags.printUser = true
+		case "explain":
+			flags.explain = true
+		case "check-provider":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return flags, nil, fmt.Errorf("option \"%s\" requires a username", arg)
+				}
+				i++
+				value = args[i]
+			}
+			flags.checkProvider = value
+		default:
+			return flags, nil, fmt.Errorf("unknown option \"%s\"", arg)
+		}
+	}
+	return flags, rest, nil
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExtractWrapperFlags(t *testing.T) {
+	var tests = []struct {
+		args  []string
+		flags wrapperFlags
+		rest  []string
+	}{
+		{[]string{"-U", "alice", "sales"}, wrapperFlags{}, []string{"-U", "alice", "sales"}},
+		{[]string{"--psqlw-check-provider", "alice", "-U", "bob"}, wrapperFlags{checkProvider: "alice"}, []string{"-U", "bob"}},
+		{[]string{"sales", "--psqlw-check-provider=alice"}, wrapperFlags{checkProvider: "alice"}, []string{"sales"}},
+		{[]string{"--psqlw-dry-run", "--psqlw-echo", "--psqlw-timing", "sales"}, wrapperFlags{dryRun: true, echo: true, timing: true}, []string{"sales"}},
+		{[]string{"--psqlw-doctor", "--psqlw-print-user", "--psqlw-explain", "--psqlw-version"}, wrapperFlags{doctor: true, printUser: true, explain: true, version: true}, nil},
+		// The arguments after "--" are left to the command
+		{[]string{"-c", "select 1", "--", "--psqlw-echo"}, wrapperFlags{}, []string{"-c", "select 1", "--", "--psqlw-echo"}},
+	}
+	for _, test := range tests {
+		clearEnv(t)
+		var flags, rest, err = extractWrapperFlags(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags != test.flags {
+			t.Errorf("flags of %q = %+v, want %+v", test.args, flags, test.flags)
+		}
+		if strings.Join(rest, "\x00") != strings.Join(test.rest, "\x00") {
+			t.Errorf("rest of %q = %q, want %q", test.args, rest, test.rest)
+		}
+	}
+}
+
+func TestLaunchWithShortOptionFollowedByEquals(t *testing.T) {
+	var tests = []struct {
+		strip  string
+		args   []string
+		quiet  bool
+		user   string
+		logged bool
+	}{
+		{"", []string{"-U=alice", "sales"}, false, "=alice", true},
+		{"", []string{"-U=alice", "sales"}, true, "=alice", false},
+		{"1", []string{"-U=alice", "sales"}, false, "alice", false},
+		{"", []string{"-Ualice", "sales"}, false, "alice", false},
+		// Left to the command after "--"
+		{"1", []string{"-U", "alice", "--", "-U=bob"}, false, "alice", false},
+	}
+	for _, test := range tests {
+		var w, out = newTestWrapper(t)
+		w.logger.quiet = test.quiet
+		var args, _ = writeCommand(t)
+		var provider, calls = writeProvider(t, "echo secret\n")
+		t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+		t.Setenv("PGW_STRIP_SHORT_EQUALS", test.strip)
+
+		if code, err := w.launch(context.Background(), "psql", test.args); code != 0 || err != nil {
+			t.Fatalf("exit code = %d, %v", code, err)
+		}
+		if got := invocations(t, calls); len(got) != 1 || got[0] != test.user {
+			t.Errorf("%q with %q: provider invoked with %q, want %q", test.args, test.strip, got, test.user)
+		}
+		var want = test.args
+		if test.strip == "1" && test.args[0] == "-U=alice" {
+			want = []string{"-Ualice", "sales"}
+		}
+		if got := args(); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%q with %q: args = %q, want %q", test.args, test.strip, got, want)
+		}
+		// Shown at the default level unless quiet
+		var message = "psqlw: value of option \"-U\" is \"=alice\" including \"=\", as psql takes it literally; set PGW_STRIP_SHORT_EQUALS to 1 to remove \"=\"\n"
+		if logged := out.String() == message; logged != test.logged {
+			t.Errorf("%q with %q: log = %q", test.args, test.strip, out.String())
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Retrieves the password from the secret store of the desktop,
+// in which the item is keyed by the host and the user
+type keychainProvider struct {
+	w *wrapper
+}
+
+func newKeychainProvider(w *wrapper) passwordProvider {
+	return &keychainProvider{w: w}
+}
+
+func (p *keychainProvider) name() string {
+	return "keychain"
+}
+
+func (p *keychainProvider) lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	var password, err = p.findPassword(ctx, info.Host, info.User)
+	if err != nil {
+		return credential{}, err
+	}
+	if password == "" {
+		return credential{}, errPasswordNotFound
+	}
+	return credential{password: password}, nil
+}
+
+func keychainError(host, user string, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return fmt.Errorf("failed to find the password for \"%s\" on \"%s\" in the keychain: %w", user, host, err)
+}
@@ -0,0 +1,26 @@
+//go:build darwin
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// Exit code of security(1) when the item is not found
+const securityItemNotFound = 44
+
+// Looks up the generic password item of the service "<name>:<host>" and the account "<user>"
+// in the macOS Keychain
+func (p *keychainProvider) findPassword(ctx context.Context, host, user string) (string, error) {
+	var output, err = p.w.runBackendCommand(ctx, "security", "find-generic-password",
+		"-s", p.w.name+":"+host, "-a", user, "-w")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityItemNotFound {
+		return "", errPasswordNotFound
+	} else if err != nil {
+		return "", keychainError(host, user, err)
+	}
+	return string(output), nil
+}
@@ -0,0 +1,49 @@
+//go:build darwin
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestKeychainProviderWithSecurity(t *testing.T) {
+	var tests = []struct {
+		user     string
+		password string
+		err      string
+	}{
+		{"alice", "secret", ""},
+		{"bob", "", errPasswordNotFound.Error()},
+		{"dave", "", "failed to find the password for \"dave\" on \"db.example.com\" in the keychain: User interaction is not allowed."},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		var dir = t.TempDir()
+		writeScript(t, dir, "security", `echo "$*" > "${0%/*}/args"
+case "$5" in
+alice) echo secret ;;
+bob) echo 'security: SecKeychainSearchCopyNext: The specified item could not be found in the keychain.' >&2; exit 44 ;;
+dave) echo 'User interaction is not allowed.' >&2; exit 36 ;;
+esac
+`)
+		t.Setenv("PATH", dir)
+
+		var cred, err = newKeychainProvider(w).lookup(context.Background(), conninfo.ConnInfo{User: test.user, Host: "db.example.com"})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("error for %s = %v, want %q", test.user, err, test.err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if cred.password != test.password {
+			t.Errorf("password of %s = %q, want %q", test.user, cred.password, test.password)
+		}
+		if got, want := readArgs(t, dir), "find-generic-password -s psqlw:db.example.com -a "+test.user+" -w"; got != want {
+			t.Errorf("arguments = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build unix && !darwin
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// Looks up the item with the attributes service=<name>, host=<host> and user=<user>
+// in the freedesktop Secret Service through secret-tool(1) of libsecret
+func (p *keychainProvider) findPassword(ctx context.Context, host, user string) (string, error) {
+	var output, err = p.w.runBackendCommand(ctx, "secret-tool", "lookup",
+		"service", p.w.name, "host", host, "user", user)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) == 0 {
+		// secret-tool fails silently when no item matches
+		return "", errPasswordNotFound
+	} else if err != nil {
+		return "", keychainError(host, user, err)
+	}
+	return string(output), nil
+}
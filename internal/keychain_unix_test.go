@@ -0,0 +1,51 @@
+//go:build unix && !darwin
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestKeychainProviderWithSecretTool(t *testing.T) {
+	var tests = []struct {
+		user     string
+		password string
+		err      string
+	}{
+		{"alice", "secret", ""},
+		{"bob", "", errPasswordNotFound.Error()},
+		{"carol", "", errPasswordNotFound.Error()},
+		{"dave", "", "failed to find the password for \"dave\" on \"db.example.com\" in the keychain: Cannot autolaunch D-Bus without X11 $DISPLAY"},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		var dir = t.TempDir()
+		// Fails silently when no item matches
+		writeScript(t, dir, "secret-tool", `echo "$*" > "${0%/*}/args"
+case "$7" in
+alice) echo secret ;;
+bob) exit 1 ;;
+dave) echo 'Cannot autolaunch D-Bus without X11 $DISPLAY' >&2; exit 1 ;;
+esac
+`)
+		t.Setenv("PATH", dir)
+
+		var cred, err = newKeychainProvider(w).lookup(context.Background(), conninfo.ConnInfo{User: test.user, Host: "db.example.com"})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("error for %s = %v, want %q", test.user, err, test.err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if cred.password != test.password {
+			t.Errorf("password of %s = %q, want %q", test.user, cred.password, test.password)
+		}
+		if got, want := readArgs(t, dir), "lookup service psqlw host db.example.com user "+test.user; got != want {
+			t.Errorf("arguments = %q, want %q", got, want)
+		}
+	}
+}
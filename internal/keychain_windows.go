@@ -0,0 +1,13 @@
+//go:build windows
+
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+// Windows Credential Manager is not supported yet
+func (p *keychainProvider) findPassword(ctx context.Context, host, user string) (string, error) {
+	return "", keychainError(host, user, errors.New("not supported on Windows"))
+}
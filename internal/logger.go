@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var logLevelNames = map[string]logLevel{
+	"error": levelError,
+	"warn":  levelWarn,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+const defaultLogLevel = levelError
+
+func parseLogLevel(name string) (logLevel, error) {
+	if level, found := logLevelNames[strings.ToLower(name)]; found {
+		return level, nil
+	}
+	return defaultLogLevel, fmt.Errorf("invalid PGW_LOG_LEVEL \"%s\"", name)
+}
+
+// Logger discarding the messages below its level
+type leveledLogger struct {
+	out   *log.Logger
+	level logLevel
+	// Name of the wrapper, which prefixes the messages in the text format
+	name string
+	// Writes the messages as JSON lines instead of text
+	json bool
+	// Discards the notices, which are otherwise written regardless of the level
+	quiet bool
+}
+
+func newLeveledLogger(out io.Writer, name string, level logLevel) *leveledLogger {
+	return &leveledLogger{
+		out:   log.New(out, name+": ", 0),
+		level: level,
+		name:  name,
+	}
+}
+
+// Sets the format of the messages, either "text" or "json"
+func (l *leveledLogger) setFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", "text":
+		l.json = false
+		l.out.SetPrefix(l.name + ": ")
+	case "json":
+		l.json = true
+		l.out.SetPrefix("")
+	default:
+		return fmt.Errorf("invalid PGW_LOG_FORMAT \"%s\"", format)
+	}
+	return nil
+}
+
+// Message written as a JSON line
+type logRecord struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Name  string `json:"name"`
+	Msg   string `json:"msg"`
+}
+
+func (l *leveledLogger) logf(level logLevel, format string, v ...any) {
+	if level <= l.level {
+		l.write(level, fmt.Sprintf(format, v...))
+	}
+}
+
+func (l *leveledLogger) write(level logLevel, message string) {
+	if !l.json {
+		l.out.Print(message)
+		return
+	}
+	// Secrets are removed before escaped in JSON, which the redactor could not find after
+	if r, ok := l.out.Writer().(*redactor); ok {
+		message = r.redact(message)
+	}
+	var record = logRecord{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Level: levelNameOf(level),
+		Name:  l.name,
+		Msg:   message,
+	}
+	var line strings.Builder
+	var encoder = json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(record); err == nil {
+		l.out.Print(line.String())
+	}
+}
+
+func levelNameOf(level logLevel) string {
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return ""
+}
+
+func (l *leveledLogger) errorf(format string, v ...any) {
+	l.logf(levelError, format, v...)
+}
+
+func (l *leveledLogger) warnf(format string, v ...any) {
+	l.logf(levelWarn, format, v...)
+}
+
+func (l *leveledLogger) infof(format string, v ...any) {
+	l.logf(levelInfo, format, v...)
+}
+
+func (l *leveledLogger) debugf(format string, v ...any) {
+	l.logf(levelDebug, format, v...)
+}
+
+// Writes the warning which the user should see even at the default level,
+// e.g. about the arguments psql takes differently than expected, unless quiet
+func (l *leveledLogger) noticef(format string, v ...any) {
+	if !l.quiet {
+		l.write(levelWarn, fmt.Sprintf(format, v...))
+	}
+}
+
+// Prints the message requested by the user regardless of the level
+func (l *leveledLogger) printf(format string, v ...any) {
+	l.write(levelInfo, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeveledLoggerDiscardsMessagesBelowLevel(t *testing.T) {
+	var tests = []struct {
+		level string
+		want  string
+	}{
+		{"error", "E"},
+		{"warn", "EW"},
+		{"info", "EWI"},
+		{"DEBUG", "EWID"},
+	}
+	for _, test := range tests {
+		var level, err = parseLogLevel(test.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		var logger = newLeveledLogger(&out, "psqlw", level)
+		logger.errorf("E")
+		logger.warnf("W")
+		logger.infof("I")
+		logger.debugf("D")
+		if got := strings.ReplaceAll(strings.ReplaceAll(out.String(), "psqlw: ", ""), "\n", ""); got != test.want {
+			t.Errorf("messages at level %s = %q, want %q", test.level, got, test.want)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("level \"verbose\" is accepted")
+	}
+}
+
+func TestNoticeIsWrittenUnlessQuiet(t *testing.T) {
+	var out bytes.Buffer
+	var logger = newLeveledLogger(&out, "psqlw", defaultLogLevel)
+	logger.noticef("-U=%s", "alice")
+	if got := out.String(); got != "psqlw: -U=alice\n" {
+		t.Errorf("notice at the default level = %q", got)
+	}
+
+	out.Reset()
+	logger.setFormat("json")
+	logger.noticef("-U=alice")
+	var record logRecord
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil || record.Level != "warn" {
+		t.Errorf("notice in JSON = %q, %v, want level warn", out.String(), err)
+	}
+
+	out.Reset()
+	logger.quiet = true
+	logger.noticef("-U=alice")
+	if out.Len() != 0 {
+		t.Errorf("notice in quiet mode = %q, want nothing", out.String())
+	}
+}
+
+func TestUndetectedUserIsLoggedAtDebugLevel(t *testing.T) {
+	for _, level := range []logLevel{defaultLogLevel, levelDebug} {
+		var w, out = newTestWrapper(t)
+		w.logger.level = level
+		t.Setenv("PGW_NO_OSUSER_FALLBACK", "1")
+
+		if _, err := w.buildEnv(context.Background(), []string{"sales"}); err != nil {
+			t.Fatal(err)
+		}
+		var logged = strings.Contains(out.String(), "Cannot detect username to login")
+		if logged != (level == levelDebug) {
+			t.Errorf("log at level %d = %q", level, out.String())
+		}
+		if level == defaultLogLevel && out.Len() != 0 {
+			t.Errorf("log at the default level = %q, want nothing", out.String())
+		}
+	}
+}
+
+func TestLeveledLoggerWritesJSON(t *testing.T) {
+	var out bytes.Buffer
+	var r = newRedactor(&out)
+	r.addSecret("s3cret")
+	var logger = newLeveledLogger(r, "psqlw", levelWarn)
+	if err := logger.setFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	logger.errorf("provider \"%s\" failed", "vault")
+	logger.warnf("password s3cret is <redacted>")
+	logger.infof("discarded")
+
+	var lines = strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	var want = []logRecord{
+		{Level: "error", Name: "psqlw", Msg: "provider \"vault\" failed"},
+		{Level: "warn", Name: "psqlw", Msg: "password *** is <redacted>"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("log = %q, want %d lines", out.String(), len(want))
+	}
+	for i, line := range lines {
+		var record logRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record.Time); err != nil {
+			t.Errorf("time of %q: %v", line, err)
+		}
+		record.Time = ""
+		if record != want[i] {
+			t.Errorf("record = %+v, want %+v", record, want[i])
+		}
+	}
+
+	// Back to the text
+	out.Reset()
+	if err := logger.setFormat("TEXT"); err != nil {
+		t.Fatal(err)
+	}
+	logger.errorf("done")
+	if got := out.String(); got != "psqlw: done\n" {
+		t.Errorf("log = %q, want %q", got, "psqlw: done\n")
+	}
+	if err := logger.setFormat("yaml"); err == nil || err.Error() != "invalid PGW_LOG_FORMAT \"yaml\"" {
+		t.Errorf("error = %v, want the invalid format", err)
+	}
+}
+
+func TestQuietLeavesStderrEmpty(t *testing.T) {
+	for _, quiet := range []string{"1", ""} {
+		var w, out = newTestWrapper(t)
+		writeCommand(t)
+		t.Setenv("PGW_NO_OSUSER_FALLBACK", "1")
+		t.Setenv("PGW_LOG_LEVEL", "debug")
+		t.Setenv("PGW_QUIET", quiet)
+
+		if code, err := w.start("psql", []string{w.path, "sales"}); code != 0 || err != nil {
+			t.Fatalf("exit code = %d, %v", code, err)
+		}
+		if quiet == "1" && out.Len() != 0 {
+			t.Errorf("log in quiet mode = %q, want nothing", out.String())
+		}
+		if quiet == "" && !strings.Contains(out.String(), "Cannot detect username to login") {
+			t.Errorf("log = %q, want the undetected user at debug level", out.String())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Writes a password file which is readable only by the current user
+func (w *wrapper) writeTempPassfile(info conninfo.ConnInfo, password string) (string, error) {
+	var file, err = os.CreateTemp("", w.name+"-*.pgpass")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a password file: %w", err)
+	}
+	defer file.Close()
+
+	w.tempFiles = append(w.tempFiles, file.Name())
+
+	// CreateTemp creates the file with mode 0600 but makes sure of it
+	if err := file.Chmod(0600); err != nil {
+		return "", fmt.Errorf("failed to create a password file: %w", err)
+	}
+
+	var host = info.Host
+	if isSocketDir(host) {
+		host = "localhost"
+	}
+	var entry = strings.Join([]string{
+		passfileField(host),
+		passfileField(info.Port),
+		passfileField(info.Dbname),
+		passfileField(info.User),
+		escapePassfileField(password),
+	}, ":")
+
+	if _, err := fmt.Fprintln(file, entry); err != nil {
+		return "", fmt.Errorf("failed to write the password file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// Returns true if the host is the directory of the Unix socket,
+// which libpq matches against "localhost" in the password file
+func isSocketDir(host string) bool {
+	return strings.HasPrefix(host, "/") || (runtime.GOOS == "windows" && filepath.IsAbs(host))
+}
+
+// Returns a field matching any value if the value is unknown
+func passfileField(value string) string {
+	if value == "" {
+		return "*"
+	}
+	return escapePassfileField(value)
+}
+
+func escapePassfileField(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, ":", `\:`)
+}
+
+// Returns the path of the password file read by libpq
+func passfilePath(info conninfo.ConnInfo) string {
+	if info.Passfile != "" {
+		return info.Passfile
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "postgresql", "pgpass.conf")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".pgpass")
+	}
+	return ""
+}
+
+// Returns the username if only one user has the password for the connection in the password file
+func (w *wrapper) searchPassfileForUser(info conninfo.ConnInfo) string {
+	var path = passfilePath(info)
+	if path == "" {
+		return ""
+	}
+	var entries, err = w.readPassfile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			w.logger.warnf("%v", err)
+		}
+		return ""
+	}
+
+	var host, port = info.Host, info.Port
+	if host == "" || isSocketDir(host) {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "5432"
+	}
+
+	var users = make(map[string]bool)
+	for _, entry := range entries {
+		// The database is unknown yet if not specified
+		if entry.matches(0, host) && entry.matches(1, port) &&
+			(info.Dbname == "" || entry.matches(2, info.Dbname)) && entry[3] != "*" {
+			users[entry[3]] = true
+		}
+	}
+	if len(users) != 1 {
+		return ""
+	}
+	for user := range users {
+		return user
+	}
+	return ""
+}
+
+// Fields of an entry in the password file: host, port, database, username, and password
+type passfileEntry [5]string
+
+func (e passfileEntry) matches(field int, value string) bool {
+	return e[field] == "*" || e[field] == value
+}
+
+func (w *wrapper) readPassfile(path string) ([]passfileEntry, error) {
+	var file, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if runtime.GOOS != "windows" {
+		var info, err = file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		// libpq ignores the file accessible by others
+		if info.Mode().Perm()&0077 != 0 {
+			w.logger.warnf("password file \"%s\" has group or world access; permissions should be u=rw (0600) or less", path)
+			return nil, nil
+		}
+	}
+
+	var entries []passfileEntry
+	var scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line = scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if entry, ok := parsePassfileLine(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Splits the line into fields separated by colons, which may be escaped by backslashes
+func parsePassfileLine(line string) (passfileEntry, bool) {
+	var entry passfileEntry
+	var field int
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line):
+			i++
+			b.WriteByte(line[i])
+		case c == ':' && field < len(entry)-1:
+			entry[field] = b.String()
+			b.Reset()
+			field++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	entry[field] = b.String()
+	return entry, field == len(entry)-1
+}
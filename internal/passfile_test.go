@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestWriteTempPassfile(t *testing.T) {
+	var tests = []struct {
+		info conninfo.ConnInfo
+		want string
+	}{
+		{conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales"}, "db.example.com:5432:sales:alice:s\\:cret\\\\\n"},
+		{conninfo.ConnInfo{User: "alice"}, "*:*:*:alice:s\\:cret\\\\\n"},
+		// libpq looks up the Unix socket as localhost
+		{conninfo.ConnInfo{User: "alice", Host: "/var/run/postgresql", Dbname: "sales"}, "localhost:*:sales:alice:s\\:cret\\\\\n"},
+		{conninfo.ConnInfo{User: "alice", Host: "/tmp", Port: "6432"}, "localhost:6432:*:alice:s\\:cret\\\\\n"},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		var path, err = w.writeTempPassfile(test.info, `s:cret\`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.want {
+			t.Errorf("password file for %+v = %q, want %q", test.info, data, test.want)
+		}
+		w.removeTempFiles()
+	}
+}
+
+func TestSearchPassfileForUser(t *testing.T) {
+	var tests = []struct {
+		info conninfo.ConnInfo
+		want string
+	}{
+		{conninfo.ConnInfo{Host: "db.example.com", Dbname: "sales"}, "alice"},
+		{conninfo.ConnInfo{Host: "db.example.com", Dbname: "hr"}, ""},
+		{conninfo.ConnInfo{Dbname: "sales"}, "local"},
+		{conninfo.ConnInfo{Host: "/var/run/postgresql", Dbname: "sales"}, "local"},
+		{conninfo.ConnInfo{Host: "/tmp", Port: "5432"}, "local"},
+		{conninfo.ConnInfo{Host: "/tmp", Port: "6432"}, ""},
+		// Two users for the host
+		{conninfo.ConnInfo{Host: "replica.example.com"}, ""},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		var path = filepath.Join(t.TempDir(), "pgpass")
+		var content = strings.Join([]string{
+			"# comment",
+			"db.example.com:5432:sales:alice:secret",
+			"localhost:5432:*:local:secret",
+			"replica.example.com:*:*:alice:secret",
+			"replica.example.com:*:*:bob:secret",
+		}, "\n")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		test.info.Passfile = path
+		if got := w.searchPassfileForUser(test.info); got != test.want {
+			t.Errorf("user for %+v = %q, want %q", test.info, got, test.want)
+		}
+	}
+}
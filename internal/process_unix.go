@@ -0,0 +1,49 @@
+//go:build unix
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Starts the command in a new process group and kills the whole group when canceled
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// Returns the file names which may be the executable of the path
+func executableCandidates(path string) []string {
+	return []string{path}
+}
+
+// Returns the exit code of the process, or 128 plus the signal number as shells do if killed by a signal
+func exitCodeOf(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// Returns an error describing how to fix the file if it exists but is not executable
+func checkExecutable(path string) error {
+	var info, err = os.Stat(path)
+	if err != nil || info.IsDir() {
+		// Leaves the error to be reported on execution
+		return nil
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("password provider \"%s\" is not executable (mode %04o); run chmod +x", path, info.Mode().Perm())
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+//go:build unix
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestExecutableCandidatesIsPathItself(t *testing.T) {
+	if got := executableCandidates("/usr/local/bin/password_provider"); len(got) != 1 || got[0] != "/usr/local/bin/password_provider" {
+		t.Errorf("candidates = %q, want the path only", got)
+	}
+}
+
+func TestCommandContextRunsFileDirectly(t *testing.T) {
+	var cmd = commandContext(context.Background(), "/usr/local/bin/provider.sh", "alice")
+	if cmd.Path != "/usr/local/bin/provider.sh" || len(cmd.Args) != 2 {
+		t.Errorf("command = %q %q, want the file itself", cmd.Path, cmd.Args)
+	}
+}
+
+func TestInvokePasswordProviderNotExecutable(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider = filepath.Join(t.TempDir(), "password_provider")
+	if err := os.WriteFile(provider, []byte("#!/bin/sh\necho secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(provider, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var _, err = w.invokePasswordProvider(context.Background(), provider, conninfo.ConnInfo{User: "alice"})
+	var want = fmt.Sprintf("password provider \"%s\" is not executable (mode 0644); run chmod +x", provider)
+	if err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+}
+
+func TestInvokePasswordProviderIsKilledOnCancel(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	// The descendant would write the file unless killed along with the provider
+	var provider, _ = writeProvider(t, `dir=$(dirname "$0")
+(sleep 0.5; echo late > "$dir/late") &
+echo started > "$dir/started"
+wait
+echo secret
+`)
+	var dir = filepath.Dir(provider)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(filepath.Join(dir, "started")); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	var start = time.Now()
+	var _, err = w.invokePasswordProvider(ctx, provider, conninfo.ConnInfo{User: "alice"})
+	if want := fmt.Sprintf("password provider \"%s\" canceled", provider); err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("provider returned after %s, want it killed", elapsed)
+	}
+	time.Sleep(time.Second)
+	if _, err := os.Stat(filepath.Join(dir, "late")); err == nil {
+		t.Errorf("descendant of the provider is still running")
+	}
+}
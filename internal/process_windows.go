@@ -0,0 +1,53 @@
+//go:build windows
+
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Process groups are not supported, only the command itself is killed when canceled
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+}
+
+// Runs batch files through the command interpreter
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".bat", ".cmd":
+		return exec.CommandContext(ctx, "cmd.exe", append([]string{"/c", name}, args...)...)
+	}
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// Returns the file names which may be the executable of the path,
+// with the extensions listed in PATHEXT appended.
+func executableCandidates(path string) []string {
+	var exts = os.Getenv("PATHEXT")
+	if exts == "" {
+		exts = ".COM;.EXE;.BAT;.CMD"
+	}
+	var candidates []string
+	if filepath.Ext(path) != "" {
+		candidates = append(candidates, path)
+	}
+	for _, ext := range filepath.SplitList(exts) {
+		if ext != "" {
+			candidates = append(candidates, path+strings.ToLower(ext))
+		}
+	}
+	return candidates
+}
+
+// Returns the exit code of the process
+func exitCodeOf(state *os.ProcessState) int {
+	return state.ExitCode()
+}
+
+// Executability is determined by the extension on Windows
+func checkExecutable(path string) error {
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build windows
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecutableCandidatesAppendsPATHEXT(t *testing.T) {
+	t.Setenv("PATHEXT", ".COM;.EXE;.BAT")
+	var got = executableCandidates(`C:\bin\password_provider`)
+	var want = []string{`C:\bin\password_provider.com`, `C:\bin\password_provider.exe`, `C:\bin\password_provider.bat`}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("candidates = %q, want %q", got, want)
+	}
+	// The path having the extension is tried as is first
+	if got := executableCandidates(`C:\bin\provider.ps1`); got[0] != `C:\bin\provider.ps1` {
+		t.Errorf("candidates = %q, want the path first", got)
+	}
+}
+
+func TestFindDefaultPasswordProviderWithExtension(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var dir = filepath.Dir(w.path)
+	var path = filepath.Join(dir, "password_provider.bat")
+	if err := os.WriteFile(path, []byte("@echo secret\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := w.findDefaultPasswordProvider(); err != nil || found != path {
+		t.Errorf("found = %q, %v, want %q", found, err, path)
+	}
+}
+
+func TestCommandContextRunsBatchFiles(t *testing.T) {
+	var cmd = commandContext(context.Background(), `C:\bin\provider.CMD`, "alice")
+	if !strings.EqualFold(filepath.Base(cmd.Path), "cmd.exe") || strings.Join(cmd.Args[1:], " ") != `/c C:\bin\provider.CMD alice` {
+		t.Errorf("command = %q %q, want cmd.exe /c", cmd.Path, cmd.Args)
+	}
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"io"
+	"regexp"
+)
+
+// Prompt shown by libpq client applications, e.g. "Password for user alice: "
+var passwordPrompt = regexp.MustCompile(`Password(?: for user [^\n]*)?: ?$`)
+
+// Copies the output of the command, and types the password once the prompt appears in it
+func copyFeedingPassword(dst io.Writer, src io.Reader, input io.Writer, password string) {
+	var buf = make([]byte, 4096)
+	// The prompt may be split across reads
+	var tail []byte
+	var feeding = true
+	for {
+		var n, err = src.Read(buf)
+		if n > 0 {
+			dst.Write(buf[:n])
+			if feeding {
+				tail = append(tail, buf[:n]...)
+				if len(tail) > 256 {
+					tail = tail[len(tail)-256:]
+				}
+				if passwordPrompt.Match(tail) {
+					io.WriteString(input, password+"\n")
+					feeding = false
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Reader returning the chunks one by one
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	var n = copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestCopyFeedingPassword(t *testing.T) {
+	var tests = []struct {
+		name   string
+		chunks []string
+		input  string
+	}{
+		{"prompt", []string{"Password for user alice: "}, "s3cret\n"},
+		{"split prompt", []string{"Pass", "word for user ", "alice: "}, "s3cret\n"},
+		{"bare prompt", []string{"Password: "}, "s3cret\n"},
+		{"prompt once", []string{"Password: ", "\nPassword: "}, "s3cret\n"},
+		{"no prompt", []string{"psql (17.0)\n", "sales=> "}, ""},
+	}
+	for _, test := range tests {
+		var output, input bytes.Buffer
+		var src = &chunkReader{chunks: append([]string(nil), test.chunks...)}
+		copyFeedingPassword(&output, src, &input, "s3cret")
+		if input.String() != test.input {
+			t.Errorf("%s: typed %q, want %q", test.name, input.String(), test.input)
+		}
+		if want := strings.Join(test.chunks, ""); output.String() != want {
+			t.Errorf("%s: output = %q, want %q", test.name, output.String(), strings.Join(test.chunks, ""))
+		}
+	}
+}
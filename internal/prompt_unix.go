@@ -0,0 +1,83 @@
+//go:build unix
+
+package internal
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+// Runs the command in a pseudo terminal, relaying the input and output of the terminal,
+// and types the password when the command prompts for it.
+func (w *wrapper) runWithPromptFeed(cmd *exec.Cmd, password string) error {
+	var stdin, stdout = os.Stdin, os.Stdout
+	var ptmx, err = pty.Start(cmd)
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+	var stop = w.relaySignals(cmd.Process)
+	defer stop()
+
+	// Keeps the window size of the pseudo terminal in sync
+	var winch = make(chan os.Signal, 1)
+	var resized = make(chan struct{})
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		defer close(resized)
+		for range winch {
+			pty.InheritSize(stdin, ptmx)
+		}
+	}()
+	defer func() {
+		signal.Stop(winch)
+		close(winch)
+		<-resized
+	}()
+	winch <- syscall.SIGWINCH
+
+	// The pseudo terminal takes over the line editing and echoing
+	var fd = int(stdin.Fd())
+	if state, err := term.MakeRaw(fd); err == nil {
+		defer term.Restore(fd, state)
+	}
+	defer copyInput(ptmx, stdin)()
+
+	// Returns when the command closes the terminal
+	copyFeedingPassword(stdout, ptmx, ptmx, password)
+	return cmd.Wait()
+}
+
+// Copies the input to the terminal in the background,
+// and returns the function which stops the copy and waits for it.
+// The input is read through a non-blocking duplicate of its descriptor,
+// as a blocking read of the input itself cannot be interrupted.
+func copyInput(dst io.Writer, src *os.File) func() {
+	var fd, err = syscall.Dup(int(src.Fd()))
+	if err != nil {
+		go io.Copy(dst, src)
+		return func() {}
+	}
+	// The flag is shared with the original descriptor and is cleared when stopped
+	syscall.SetNonblock(fd, true)
+	var input = os.NewFile(uintptr(fd), src.Name())
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(dst, input)
+	}()
+	return func() {
+		if input.SetReadDeadline(time.Now()) == nil {
+			<-done
+		}
+		syscall.SetNonblock(fd, false)
+		input.Close()
+	}
+}
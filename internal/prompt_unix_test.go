@@ -0,0 +1,96 @@
+//go:build unix
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestRunWithPromptFeedTypesPassword(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var dir = t.TempDir()
+	var result = filepath.Join(dir, "result")
+	var command = writeScript(t, dir, "psql", "printf 'Password for user alice: '\nread -r password\necho \"$password\" > '"+result+"'\n")
+
+	// The output of the command is copied to the standard output
+	var stdout, err = os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	var saved = os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = saved }()
+
+	if err := w.runWithPromptFeed(exec.Command(command), "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(result); err != nil || string(got) != "s3cret\n" {
+		t.Errorf("command read %q, %v, want the password", got, err)
+	}
+}
+
+func TestCopyInputStopsWaitingForTerminal(t *testing.T) {
+	var ptmx, tty, err = pty.Open()
+	if err != nil {
+		t.Skipf("no pseudo terminal: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	if _, err := ptmx.Write([]byte("select 1;\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var copied = new(bytes.Buffer)
+	var stop = copyInput(copied, tty)
+	time.Sleep(100 * time.Millisecond)
+	// Returns while the terminal has nothing more to read
+	var stopped = make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("copy of the input did not stop")
+	}
+	if got := copied.String(); got != "select 1;\n" {
+		t.Errorf("copied %q, want the typed line", got)
+	}
+}
+
+func TestProviderReadsTerminal(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var ptmx, tty, err = pty.Open()
+	if err != nil {
+		t.Skipf("no pseudo terminal: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	var saved = os.Stdin
+	os.Stdin = tty
+	defer func() { os.Stdin = saved }()
+
+	// Typed by the user on the terminal to unlock the secret store
+	if _, err := ptmx.Write([]byte("1234\n")); err != nil {
+		t.Fatal(err)
+	}
+	var provider, _ = writeProvider(t, "read -r pin\nif [ \"$pin\" = 1234 ]; then echo secret; fi\n")
+	var cred, invokeErr = w.invokePasswordProvider(context.Background(), provider, conninfo.ConnInfo{User: "alice"})
+	if invokeErr != nil {
+		t.Fatal(invokeErr)
+	}
+	if cred.password != "secret" {
+		t.Errorf("password = %q, want the one unlocked on the terminal", cred.password)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package internal
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func (w *wrapper) runWithPromptFeed(cmd *exec.Cmd, password string) error {
+	return errors.New("PGW_PROMPT_FEED is not supported on Windows")
+}
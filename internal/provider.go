@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Source of the passwords, either built in the wrapper or external to it
+type passwordProvider interface {
+	// Returns the name of the provider shown in the log messages
+	name() string
+	// Returns errPasswordNotFound if no password is stored for the user
+	lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error)
+}
+
+// Built-in providers selected by PGW_PROVIDER
+var builtinProviders = map[string]func(w *wrapper) passwordProvider{
+	"vault":         newVaultProvider,
+	"aws-secrets":   newAWSSecretsProvider,
+	"keychain":      newKeychainProvider,
+	"systemd-creds": newSystemdCredsProvider,
+}
+
+var errNoPasswordProvider = errors.New("environment variable PGW_PASSWORD_PROVIDER is undefined")
+
+// Selects the providers to be tried in order, which are the built-in one given by PGW_PROVIDER,
+// the daemon listening on PGW_PROVIDER_SOCKET, or the commands in PGW_PASSWORD_PROVIDER
+func (w *wrapper) selectPasswordProviders(info conninfo.ConnInfo) ([]passwordProvider, error) {
+	if name := w.getenv("PGW_PROVIDER"); name != "" {
+		var provider, err = w.builtinProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		return []passwordProvider{provider}, nil
+	}
+	if socket := w.getenv("PGW_PROVIDER_SOCKET"); socket != "" {
+		return []passwordProvider{&socketProvider{w: w, path: socket}}, nil
+	}
+	var paths, err = w.getPasswordProviders(info.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errNoPasswordProvider
+	}
+	var providers []passwordProvider
+	for _, path := range paths {
+		providers = append(providers, &execProvider{w: w, path: path})
+	}
+	return providers, nil
+}
+
+func (w *wrapper) builtinProvider(name string) (passwordProvider, error) {
+	var newProvider, found = builtinProviders[name]
+	if !found {
+		return nil, fmt.Errorf("unknown password provider \"%s\" in PGW_PROVIDER", name)
+	}
+	return newProvider(w), nil
+}
+
+// Takes the password and the optional username from the fields of the secret,
+// and returns errPasswordNotFound if the password is empty
+func credentialFromFields(fields map[string]json.RawMessage) (credential, error) {
+	var cred credential
+	for name, field := range map[string]*string{"password": &cred.password, "username": &cred.username} {
+		if raw, found := fields[name]; found {
+			if err := json.Unmarshal(raw, field); err != nil {
+				return credential{}, fmt.Errorf("has invalid \"%s\"", name)
+			}
+		}
+	}
+	if cred.password == "" {
+		return credential{}, errPasswordNotFound
+	}
+	return cred, nil
+}
+
+// Runs the command of the backend with the provider timeout, and returns its standard output.
+// The standard error is returned in *exec.ExitError on failure.
+func (w *wrapper) runBackendCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var timeout, err = w.getProviderTimeout()
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	defer w.logProviderTime(name, time.Now())
+
+	var cmd = exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = time.Second
+	stdout, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%s timed out after %s", name, timeout)
+	}
+	return bytes.TrimSpace(stdout), err
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+const redacted = "***"
+
+// Writer replacing the secrets in the output with asterisks
+type redactor struct {
+	out     io.Writer
+	mu      sync.Mutex
+	secrets []string
+}
+
+func newRedactor(out io.Writer) *redactor {
+	return &redactor{out: out}
+}
+
+// Adds the secret to be redacted from the subsequent output
+func (r *redactor) addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = append(r.secrets, secret)
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.out, r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
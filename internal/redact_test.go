@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestRedactorReplacesSecrets(t *testing.T) {
+	var out bytes.Buffer
+	var r = newRedactor(&out)
+	r.addSecret("s3cret")
+	r.addSecret("")
+	var logger = newLeveledLogger(r, "psqlw", levelDebug)
+	logger.debugf("connecting with s3cret and again s3cret")
+	if got, want := out.String(), "psqlw: connecting with *** and again ***\n"; got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestRetrievedPasswordIsRedacted(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	var provider, _ = writeProvider(t, "echo s3cret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	if _, err := w.retrievePasswordForUser(context.Background(), conninfo.ConnInfo{User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	w.logger.errorf("failed to connect with password s3cret")
+	if strings.Contains(out.String(), "s3cret") || !strings.Contains(out.String(), "password ***") {
+		t.Errorf("log = %q, want the password redacted", out.String())
+	}
+}
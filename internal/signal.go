@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Time given to the child process to exit after SIGTERM before it is killed
+const defaultKillGrace = 10 * time.Second
+
+// Relays the signals received by the wrapper to the child process
+// until the returned function is called.
+// The child process is killed if it does not exit within PGW_KILL_GRACE after SIGTERM.
+func (w *wrapper) relaySignals(process *os.Process) func() {
+	var signals = make(chan os.Signal, 1)
+	var done = make(chan struct{})
+
+	var grace, err = w.getDuration("PGW_KILL_GRACE", defaultKillGrace)
+	if err != nil {
+		w.logger.warnf("%v", err)
+		grace = defaultKillGrace
+	}
+	// Receives nothing until SIGTERM is relayed
+	var kill <-chan time.Time
+
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// SIGINT from the terminal is delivered to the whole process group,
+	// so the child has already received it.
+	var interactive = isTerminal(os.Stdin)
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == os.Interrupt && interactive {
+					continue
+				}
+				if err := process.Signal(sig); err != nil {
+					w.logger.warnf("%v", err)
+				}
+				if sig == syscall.SIGTERM && kill == nil && grace > 0 {
+					kill = time.After(grace)
+				}
+			case <-kill:
+				w.logger.warnf("command did not exit within %s after SIGTERM, killing it", grace)
+				if err := process.Kill(); err != nil {
+					w.logger.warnf("%v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// Catches SIGPIPE until the returned function is called, so that writing to the pipe closed
+// by the reader fails with EPIPE instead of killing the wrapper before the command exits.
+// Unlike signal.Ignore, catching it does not affect the disposition inherited by the command.
+func catchBrokenPipe() func() {
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGPIPE)
+	return func() {
+		signal.Stop(signals)
+	}
+}
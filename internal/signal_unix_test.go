@@ -0,0 +1,181 @@
+//go:build unix
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// Child which reports SIGINT on its standard output and exits with 3 on SIGTERM
+const trappingChild = `trap 'echo INT' INT
+trap 'exit 3' TERM
+echo ready
+while :; do sleep 0.1; done
+`
+
+// Starts the script once it is ready, and relays the signals to it until the returned function is called
+func startRelayed(t *testing.T, w *wrapper, body string) (*exec.Cmd, *bufio.Reader, func()) {
+	t.Helper()
+	var cmd = exec.Command(writeScript(t, t.TempDir(), "child", body))
+	var stdout, err = cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	var reader = bufio.NewReader(stdout)
+	if line, err := reader.ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("child is not ready: %q, %v", line, err)
+	}
+	return cmd, reader, w.relaySignals(cmd.Process)
+}
+
+// Sends the signal to the test itself, which is caught while relayed
+func raise(t *testing.T, sig syscall.Signal) {
+	t.Helper()
+	if err := syscall.Kill(os.Getpid(), sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelaySignalsForwardsSignals(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var cmd, stdout, stop = startRelayed(t, w, trappingChild)
+	defer stop()
+
+	raise(t, syscall.SIGINT)
+	if line, err := stdout.ReadString('\n'); err != nil || line != "INT\n" {
+		t.Errorf("child output = %q, %v, want SIGINT to be relayed", line, err)
+	}
+	raise(t, syscall.SIGTERM)
+	cmd.Wait()
+	if code := exitCodeOf(cmd.ProcessState); code != 3 {
+		t.Errorf("exit code = %d, want 3 by SIGTERM", code)
+	}
+}
+
+func TestRelaySignalsLeavesInterruptToTerminal(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var ptmx, tty, err = pty.Open()
+	if err != nil {
+		t.Skipf("no pseudo terminal: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	// The terminal delivers SIGINT to the whole process group by itself
+	var saved = os.Stdin
+	os.Stdin = tty
+	defer func() { os.Stdin = saved }()
+
+	var cmd, stdout, stop = startRelayed(t, w, trappingChild)
+	defer stop()
+
+	raise(t, syscall.SIGINT)
+	time.Sleep(300 * time.Millisecond)
+	raise(t, syscall.SIGTERM)
+	// Read until the child exits
+	if rest, _ := io.ReadAll(stdout); strings.Contains(string(rest), "INT") {
+		t.Errorf("SIGINT is relayed on the terminal")
+	}
+	cmd.Wait()
+	if code := exitCodeOf(cmd.ProcessState); code != 3 {
+		t.Errorf("exit code = %d, want 3 by SIGTERM", code)
+	}
+}
+
+func TestRunCommandExitCode(t *testing.T) {
+	var tests = []struct {
+		body string
+		code int
+	}{
+		{"exit 0\n", 0},
+		{"exit 7\n", 7},
+		{"kill -TERM $$\n", 143},
+		{"kill -KILL $$\n", 137},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		var command = writeScript(t, t.TempDir(), "psql", test.body)
+		var code, err = w.runCommand(context.Background(), command, nil, os.Environ())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.code {
+			t.Errorf("exit code of %q = %d, want %d", test.body, code, test.code)
+		}
+	}
+}
+
+func TestRunCommandWithPipeClosedEarly(t *testing.T) {
+	var tests = []struct {
+		name string
+		body string
+		code int
+	}{
+		{"killed by SIGPIPE", "echo first\nsleep 0.2\necho second\nexit 3\n", 141},
+		{"ignoring SIGPIPE", "trap '' PIPE\necho first\nsleep 0.2\necho second 2>/dev/null\nexit 3\n", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var command = writeScript(t, t.TempDir(), "psql", test.body)
+			var r, pw, err = os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved = os.Stdout
+			os.Stdout = pw
+			defer func() { os.Stdout = saved }()
+			// Reads only the first line like head -1
+			go func() {
+				bufio.NewReader(r).ReadString('\n')
+				r.Close()
+			}()
+
+			var code, runErr = w.runCommand(context.Background(), command, nil, os.Environ())
+			pw.Close()
+			if runErr != nil {
+				t.Fatal(runErr)
+			}
+			if code != test.code {
+				t.Errorf("exit code = %d, want %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestRelaySignalsKillsChildIgnoringSIGTERM(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	w.logger.level = levelWarn
+	t.Setenv("PGW_KILL_GRACE", "200ms")
+	var cmd, _, stop = startRelayed(t, w, "trap '' TERM\necho ready\nwhile :; do sleep 0.1; done\n")
+	defer stop()
+
+	var start = time.Now()
+	raise(t, syscall.SIGTERM)
+	cmd.Wait()
+	if code := exitCodeOf(cmd.ProcessState); code != 137 {
+		t.Errorf("exit code = %d, want 137 by SIGKILL", code)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("killed after %s, want after the grace period", elapsed)
+	}
+	if !strings.Contains(out.String(), "command did not exit within 200ms after SIGTERM, killing it") {
+		t.Errorf("log = %q, want the kill", out.String())
+	}
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Request sent to the provider daemon as a single line of JSON
+type socketRequest struct {
+	Command string `json:"command"`
+	User    string `json:"user"`
+	Host    string `json:"host"`
+	Port    string `json:"port"`
+	Dbname  string `json:"dbname"`
+	Service string `json:"service"`
+}
+
+// Provider daemon listening on the Unix domain socket
+type socketProvider struct {
+	w    *wrapper
+	path string
+}
+
+func (p *socketProvider) name() string {
+	return p.path
+}
+
+func (p *socketProvider) lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	var cred, err = p.w.requestPasswordFromSocket(ctx, p.path, info)
+	if err == nil && cred.password == "" {
+		return credential{}, errPasswordNotFound
+	}
+	return cred, err
+}
+
+// Requests the password from the provider daemon listening on the Unix domain socket.
+// The daemon replies with a single line in the same format as the output of the provider,
+// and an empty line means no password is stored for the user.
+func (w *wrapper) requestPasswordFromSocket(ctx context.Context, path string, info conninfo.ConnInfo) (credential, error) {
+	var timeout, err = w.getProviderTimeout()
+	if err != nil {
+		return credential{}, err
+	}
+	defer w.logProviderTime(path, time.Now())
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return credential{}, fmt.Errorf("failed to connect to the password provider: %w", err)
+	}
+	defer conn.Close()
+	// Interrupts the request when canceled
+	var stop = context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	var request = socketRequest{
+		Command: w.command,
+		User:    info.User,
+		Host:    info.Host,
+		Port:    info.Port,
+		Dbname:  info.Dbname,
+		Service: info.Service,
+	}
+	line, err := json.Marshal(request)
+	if err != nil {
+		return credential{}, err
+	}
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return credential{}, fmt.Errorf("failed to send the request to the password provider \"%s\": %w", path, err)
+	}
+
+	response, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return credential{}, fmt.Errorf("failed to read the response from the password provider \"%s\": %w", path, err)
+	}
+	return w.parseProviderOutput(path, response)
+}
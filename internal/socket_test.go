@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Starts the daemon replying to each request with the line returned by the function
+func startSocketProvider(t *testing.T, reply func(socketRequest) string) string {
+	t.Helper()
+	var path = filepath.Join(t.TempDir(), "provider.sock")
+	var listener, err = net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix domain socket is not available: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			var conn, err = listener.Accept()
+			if err != nil {
+				return
+			}
+			var line, _ = bufio.NewReader(conn).ReadBytes('\n')
+			var request socketRequest
+			if err := json.Unmarshal(line, &request); err == nil {
+				conn.Write([]byte(reply(request) + "\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return path
+}
+
+func TestSocketProvider(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var path = startSocketProvider(t, func(request socketRequest) string {
+		switch {
+		case request.Command != "psql" || request.Host != "db.example.com" || request.Dbname != "sales":
+			return ""
+		case request.User == "alice":
+			return "secret"
+		case request.User == "bob":
+			return `{"password": "hunter2", "sslmode": "require"}`
+		}
+		return ""
+	})
+	t.Setenv("PGW_PROVIDER_SOCKET", path)
+
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales"}
+	if cred, _, err := w.fetchPassword(context.Background(), info); err != nil || cred.password != "secret" {
+		t.Errorf("password of alice = %q, %v, want %q", cred.password, err, "secret")
+	}
+	info.User = "bob"
+	if cred, _, err := w.fetchPassword(context.Background(), info); err != nil || cred.password != "hunter2" || cred.settings["PGSSLMODE"] != "require" {
+		t.Errorf("credential of bob = %+v, %v, want the password and sslmode", cred, err)
+	}
+	// An empty line means no password
+	info.User = "carol"
+	var provider = &socketProvider{w: w, path: path}
+	if _, err := provider.lookup(context.Background(), info); !errors.Is(err, errPasswordNotFound) {
+		t.Errorf("error for carol = %v, want %v", err, errPasswordNotFound)
+	}
+}
+
+func TestSocketProviderNotListening(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var _, err = w.requestPasswordFromSocket(context.Background(), filepath.Join(t.TempDir(), "missing.sock"), conninfo.ConnInfo{User: "alice"})
+	if err == nil {
+		t.Errorf("missing socket is accepted")
+	}
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Name of the credential by default
+const defaultSystemdCredential = "{user}"
+
+// Retrieves the password from the credentials passed by systemd to the service,
+// e.g. by LoadCredential= or SetCredentialEncrypted= in the unit file
+type systemdCredsProvider struct {
+	w *wrapper
+}
+
+func newSystemdCredsProvider(w *wrapper) passwordProvider {
+	return &systemdCredsProvider{w: w}
+}
+
+func (p *systemdCredsProvider) name() string {
+	return "systemd-creds"
+}
+
+func (p *systemdCredsProvider) lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	var dir = os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return credential{}, errors.New("environment variable CREDENTIALS_DIRECTORY is undefined, which is set by systemd for the service having credentials")
+	}
+	var name = p.w.getenv("PGW_SYSTEMD_CREDENTIAL")
+	if name == "" {
+		name = defaultSystemdCredential
+	}
+	// The values must not slip out of the directory, e.g. the host of the Unix socket
+	name = placeholderReplacer(info, escapeCredentialName).Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return credential{}, fmt.Errorf("invalid name of the credential \"%s\"", name)
+	}
+
+	var content, err = os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return credential{}, errPasswordNotFound
+	} else if err != nil {
+		return credential{}, fmt.Errorf("failed to read the credential \"%s\": %w", name, err)
+	}
+	// The file written by echo ends with a newline
+	var password = strings.TrimRight(string(content), "\r\n")
+	if password == "" {
+		return credential{}, errPasswordNotFound
+	}
+	return credential{password: password}, nil
+}
+
+func escapeCredentialName(value string) string {
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(value)
+}
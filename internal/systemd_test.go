@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+func TestSystemdCredsProvider(t *testing.T) {
+	var tests = []struct {
+		name     string
+		template string
+		info     conninfo.ConnInfo
+		password string
+		err      string
+	}{
+		{"user", "", conninfo.ConnInfo{User: "alice"}, "secret", ""},
+		{"template", "pg-{host}-{user}", conninfo.ConnInfo{User: "alice", Host: "db.example.com"}, "hosted", ""},
+		// The socket directory is flattened into the name
+		{"socket", "pg-{host}-{user}", conninfo.ConnInfo{User: "alice", Host: "/var/run/postgresql"}, "local", ""},
+		{"missing", "", conninfo.ConnInfo{User: "bob"}, "", errPasswordNotFound.Error()},
+		{"empty", "", conninfo.ConnInfo{User: "carol"}, "", errPasswordNotFound.Error()},
+		{"escaping", "", conninfo.ConnInfo{User: "../alice"}, "", errPasswordNotFound.Error()},
+		{"invalid", "{dbname}", conninfo.ConnInfo{User: "alice", Dbname: ".."}, "", "invalid name of the credential \"..\""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var dir = t.TempDir()
+			for name, content := range map[string]string{
+				"alice":                        "secret\n",
+				"pg-db.example.com-alice":      "hosted\r\n",
+				"pg-_var_run_postgresql-alice": "local",
+				"carol":                        "\n",
+			} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0400); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("CREDENTIALS_DIRECTORY", dir)
+			t.Setenv("PGW_SYSTEMD_CREDENTIAL", test.template)
+
+			var cred, err = newSystemdCredsProvider(w).lookup(context.Background(), test.info)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("error = %v, want %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if cred.password != test.password {
+				t.Errorf("password = %q, want %q", cred.password, test.password)
+			}
+		})
+	}
+}
+
+func TestBuildEnvWithSystemdCreds(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_PROVIDER", "systemd-creds")
+	// Not run by systemd
+	if _, err := w.buildEnv(context.Background(), []string{"-U", "alice", "sales"}); err == nil ||
+		err.Error() != "environment variable CREDENTIALS_DIRECTORY is undefined, which is set by systemd for the service having credentials" {
+		t.Errorf("error = %v, want CREDENTIALS_DIRECTORY undefined", err)
+	}
+
+	var dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "alice"), []byte("secret\n"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	var env, err = w.buildEnv(context.Background(), []string{"-U", "alice", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != "secret" {
+		t.Errorf("PGPASSWORD = %q, want %q", got, "secret")
+	}
+}
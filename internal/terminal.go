@@ -0,0 +1,11 @@
+package internal
+
+import (
+	"os"
+
+	"golang.org/x/term"
+)
+
+func isTerminal(file *os.File) bool {
+	return term.IsTerminal(int(file.Fd()))
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Path of the secret in Vault by default, which is in the KV secrets engine version 2
+const defaultVaultPath = "secret/data/psqlw/{host}/{user}"
+
+// Retrieves the password from the secret of HashiCorp Vault
+type vaultProvider struct {
+	w *wrapper
+}
+
+func newVaultProvider(w *wrapper) passwordProvider {
+	return &vaultProvider{w: w}
+}
+
+func (p *vaultProvider) name() string {
+	return "vault"
+}
+
+func (p *vaultProvider) lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	var addr = os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return credential{}, errors.New("environment variable VAULT_ADDR is undefined")
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return credential{}, err
+	}
+	timeout, err := p.w.getProviderTimeout()
+	if err != nil {
+		return credential{}, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	defer p.w.logProviderTime("vault", time.Now())
+
+	var path = p.w.getenv("PGW_VAULT_PATH")
+	if path == "" {
+		path = defaultVaultPath
+	}
+	// The values are escaped not to change the structure of the path
+	path = placeholderReplacer(info, url.PathEscape).Replace(path)
+	var endpoint = strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return credential{}, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return credential{}, fmt.Errorf("failed to read the secret from Vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return credential{}, errPasswordNotFound
+	default:
+		var body, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return credential{}, fmt.Errorf("failed to read the secret \"%s\" from Vault: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return credential{}, fmt.Errorf("invalid response from Vault: %w", err)
+	}
+	var data = secret.Data
+	// The KV secrets engine version 2 nests the data with its metadata
+	if nested, found := data["data"]; found {
+		if _, versioned := data["metadata"]; versioned {
+			data = nil
+			if err := json.Unmarshal(nested, &data); err != nil {
+				return credential{}, fmt.Errorf("invalid response from Vault: %w", err)
+			}
+		}
+	}
+
+	cred, err := credentialFromFields(data)
+	if err != nil && !errors.Is(err, errPasswordNotFound) {
+		return credential{}, fmt.Errorf("secret \"%s\" in Vault %w", path, err)
+	}
+	return cred, err
+}
+
+// Returns VAULT_TOKEN, or the token saved by vault login
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	var home, err = os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", errors.New("environment variable VAULT_TOKEN is undefined, and no token is saved by vault login")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Starts the server of Vault responding to the paths with the bodies, or 404 for the others,
+// and returns the requests received as "token namespace path"
+func startVault(t *testing.T, secrets map[string]string) *[]string {
+	t.Helper()
+	var requests []string
+	var server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Header.Get("X-Vault-Token")+" "+req.Header.Get("X-Vault-Namespace")+" "+req.URL.EscapedPath())
+		var body, found = secrets[req.URL.EscapedPath()]
+		switch {
+		case req.Header.Get("X-Vault-Token") != "s.token":
+			http.Error(rw, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		case !found:
+			http.Error(rw, `{"errors":[]}`, http.StatusNotFound)
+		default:
+			rw.Write([]byte(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("VAULT_ADDR", server.URL+"/")
+	return &requests
+}
+
+func TestVaultProvider(t *testing.T) {
+	var tests = []struct {
+		name     string
+		path     string
+		info     conninfo.ConnInfo
+		username string
+		password string
+		err      string
+	}{
+		{"KV version 2", "", conninfo.ConnInfo{User: "alice", Host: "db.example.com"}, "", "secret", ""},
+		{"KV version 1", "kv/{dbname}/{user}", conninfo.ConnInfo{User: "alice", Dbname: "sales"}, "svc_sales", "secret", ""},
+		{"escaped", "kv/{dbname}/{user}", conninfo.ConnInfo{User: "alice", Dbname: "a/b c"}, "", "escaped", ""},
+		{"not found", "", conninfo.ConnInfo{User: "bob", Host: "db.example.com"}, "", "", errPasswordNotFound.Error()},
+		{"no password", "kv/{dbname}/{user}", conninfo.ConnInfo{User: "carol", Dbname: "sales"}, "", "", errPasswordNotFound.Error()},
+		{"invalid password", "kv/{dbname}/{user}", conninfo.ConnInfo{User: "dave", Dbname: "sales"}, "", "",
+			"secret \"kv/sales/dave\" in Vault has invalid \"password\""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var requests = startVault(t, map[string]string{
+				"/v1/secret/data/psqlw/db.example.com/alice": `{"data":{"data":{"password":"secret"},"metadata":{"version":3}}}`,
+				"/v1/kv/sales/alice":                         `{"data":{"username":"svc_sales","password":"secret"}}`,
+				"/v1/kv/a%2Fb%20c/alice":                     `{"data":{"password":"escaped"}}`,
+				"/v1/kv/sales/carol":                         `{"data":{"username":"carol"}}`,
+				"/v1/kv/sales/dave":                          `{"data":{"password":42}}`,
+			})
+			t.Setenv("VAULT_TOKEN", "s.token")
+			t.Setenv("VAULT_NAMESPACE", "team")
+			t.Setenv("PGW_VAULT_PATH", test.path)
+
+			var cred, err = newVaultProvider(w).lookup(context.Background(), test.info)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("error = %v, want %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if cred.username != test.username || cred.password != test.password {
+				t.Errorf("credential = %q, %q, want %q, %q", cred.username, cred.password, test.username, test.password)
+			}
+			if len(*requests) != 1 || !strings.HasPrefix((*requests)[0], "s.token team /v1/") {
+				t.Errorf("requests = %q, want one with the token and the namespace", *requests)
+			}
+		})
+	}
+}
+
+func TestVaultProviderErrors(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com"}
+	if _, err := newVaultProvider(w).lookup(context.Background(), info); err == nil || err.Error() != "environment variable VAULT_ADDR is undefined" {
+		t.Errorf("error = %v, want VAULT_ADDR undefined", err)
+	}
+
+	var requests = startVault(t, nil)
+	if _, err := newVaultProvider(w).lookup(context.Background(), info); err == nil || !strings.Contains(err.Error(), "VAULT_TOKEN is undefined") {
+		t.Errorf("error = %v, want VAULT_TOKEN undefined", err)
+	}
+
+	// The token saved by vault login
+	var home, _ = os.UserHomeDir()
+	if err := os.WriteFile(filepath.Join(home, ".vault-token"), []byte("s.saved\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var _, err = newVaultProvider(w).lookup(context.Background(), info)
+	if want := "failed to read the secret \"secret/data/psqlw/db.example.com/alice\" from Vault: 403 Forbidden: {\"errors\":[\"permission denied\"]}"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+	if errors.Is(err, errPasswordNotFound) {
+		t.Errorf("denied secret is taken as not found")
+	}
+	if len(*requests) != 1 || !strings.HasPrefix((*requests)[0], "s.saved ") {
+		t.Errorf("requests = %q, want the saved token", *requests)
+	}
+}
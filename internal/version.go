@@ -0,0 +1,19 @@
+package internal
+
+import "runtime/debug"
+
+// Version of the wrapper, which is set at build time like below:
+//
+//	go build -ldflags "-X github.com/openclosed-dev/psql-wrapper/internal.version=v1.0.0" ./cmd/psqlw
+var version = ""
+
+// Returns the version set at build time, or the module version if installed by go install
+func wrapperVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
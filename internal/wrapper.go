@@ -1,278 +1,896 @@
 package internal
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
 )
 
 type wrapper struct {
 	name   string
-	logger *log.Logger
-	path   string
+	logger *leveledLogger
+	// Removes passwords from the log output
+	redactor *redactor
+	path     string
+	// Credentials retrieved from the provider during this invocation
+	credentials map[passwordKey]credential
+	// Command to be wrapped
+	command string
+	// Temporary files to be removed on exit
+	tempFiles []string
+	// Password to be typed into the prompt of the command
+	promptPassword string
+	// Values in the config file by the environment variable names
+	config map[string]string
+	// Prints the time taken by the provider regardless of the log level
+	timing bool
 }
 
 const defaultPasswordProvider = "password_provider"
 
+// Launches the command with the password retrieved from the provider,
+// and returns the exit code of the command. Errors are logged to stderr.
 func Launch(name string, command string, args []string) int {
+	var w = newWrapper(name)
+	var exitCode, err = w.start(command, args)
+	if err != nil {
+		w.logger.errorf("%v", err)
+	}
+	return exitCode
+}
+
+// Same as Launch, but returns the error instead of logging it.
+// The exit code is non-zero whenever the error is returned.
+func LaunchE(name string, command string, args []string) (int, error) {
+	return newWrapper(name).start(command, args)
+}
+
+func newWrapper(name string) *wrapper {
+	var redactor = newRedactor(os.Stderr)
+	return &wrapper{
+		name:        name,
+		logger:      newLeveledLogger(redactor, name, defaultLogLevel),
+		redactor:    redactor,
+		credentials: make(map[passwordKey]credential),
+	}
+}
+
+// Configures the wrapper, and launches the command with the arguments including the program name
+func (w *wrapper) start(command string, args []string) (int, error) {
+
+	// The program name is required to locate the files next to the wrapper
+	if len(args) == 0 {
+		return 1, errors.New("no arguments given, not even the program name")
+	}
+	w.path = args[0]
+
+	if err := w.loadConfig(); err != nil {
+		return w.providerErrorExitCode(), err
+	}
 
-	var w = wrapper{
-		name:   name,
-		logger: log.New(os.Stderr, name+": ", 0),
-		path:   args[0],
+	if err := w.logger.setFormat(w.getenv("PGW_LOG_FORMAT")); err != nil {
+		w.logger.errorf("%v", err)
 	}
 
-	return w.launch(command, args[1:])
+	if value := w.getenv("PGW_LOG_LEVEL"); value != "" {
+		var level, err = parseLogLevel(value)
+		if err != nil {
+			w.logger.errorf("%v", err)
+		}
+		w.logger.level = level
+	} else if w.getenv("PGW_DEBUG") == "1" {
+		w.logger.level = levelDebug
+	}
+	// Scripts may silence everything but the errors whatever the level is
+	if w.getenv("PGW_QUIET") == "1" {
+		w.logger.level = levelError
+		w.logger.quiet = true
+	}
+
+	if derived := commandForName(filepath.Base(args[0])); derived != "" {
+		command = derived
+	}
+
+	w.command = command
+
+	return w.launch(context.Background(), command, args[1:])
 }
 
-func (w *wrapper) launch(command string, args []string) int {
+func (w *wrapper) launch(ctx context.Context, command string, args []string) (int, error) {
+
+	defer w.removeTempFiles()
 
-	env, err := w.buildEnv(args)
+	flags, args, err := extractWrapperFlags(args)
 	if err != nil {
-		w.logger.Println(err)
-		return 1
+		return 1, err
+	}
+	if w.getenv("PGW_DRY_RUN") == "1" {
+		flags.dryRun = true
+	}
+
+	if flags.version {
+		fmt.Printf("%s %s\n", w.name, wrapperVersion())
+		return 0, nil
 	}
 
-	exitCode, err := w.runCommand(command, args, env)
+	w.timing = flags.timing
+
+	extraArgs, err := w.getExtraArgs()
 	if err != nil {
-		w.logger.Println(err)
+		return w.providerErrorExitCode(), err
 	}
+	// Placed first so that the options given by the user override them
+	args = append(extraArgs, args...)
 
-	return exitCode
+	args = w.checkShortEquals(args, w.getenv("PGW_STRIP_SHORT_EQUALS") == "1")
+
+	if flags.doctor {
+		return w.runDoctor(command, args), nil
+	}
+
+	if flags.explain {
+		w.runExplain(args)
+		return 0, nil
+	}
+
+	if flags.printUser {
+		var info, _, _ = w.searchForConnInfo(args)
+		if info.User == "" {
+			return 1, errors.New("cannot detect username to login")
+		}
+		fmt.Println(info.User)
+		return 0, nil
+	}
+
+	if flags.checkProvider != "" {
+		return w.checkProvider(ctx, flags.checkProvider, args)
+	}
+
+	path, err := w.resolveCommand(command)
+	if err != nil {
+		return 1, err
+	}
+
+	// Cancels the provider on the signals until the command is started,
+	// after which they are relayed to the command
+	providerCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	env, err := w.buildEnv(providerCtx, args)
+	stop()
+	if err != nil {
+		return w.providerErrorExitCode(), err
+	}
+
+	if flags.dryRun {
+		w.printCommand(path, args, env)
+		return 0, nil
+	}
+
+	if flags.echo {
+		w.logger.printf("%s", echoCommandLine(path, args, env))
+	}
+
+	return w.runCommand(ctx, path, args, env)
+}
+
+// Runs the provider for the user, and reports the result without printing the password
+func (w *wrapper) checkProvider(ctx context.Context, user string, args []string) (int, error) {
+	var info, _, _ = w.searchForConnInfo(args)
+	info.User = user
+	var cred, err = w.retrievePasswordForUser(ctx, info)
+	if err != nil {
+		return 1, err
+	}
+	if cred.password == "" {
+		return 1, fmt.Errorf("no password found for user \"%s\"", user)
+	}
+	w.logger.printf("ok")
+	return 0, nil
 }
 
-func (w *wrapper) buildEnv(args []string) ([]string, error) {
-	var env = os.Environ()
-	var username = w.searchForUsername(args)
-	if username == "" {
-		w.logger.Printf("Cannot detect username to login")
+// Returns the environment of the command, in which a variable appears only once
+func (w *wrapper) buildEnv(ctx context.Context, args []string) ([]string, error) {
+	var env, err = w.extendEnv(ctx, os.Environ(), args)
+	return dedupEnv(env), err
+}
+
+func (w *wrapper) extendEnv(ctx context.Context, env []string, args []string) ([]string, error) {
+	var info, sources, opts = w.searchForConnInfo(args)
+	if opts.noConnection {
+		w.logger.debugf("password is not retrieved as the command prints only its version or help")
+		return env, nil
+	}
+	if opts.noPassword {
+		// Tells why the password of the provider does not take effect
+		if os.Getenv("PGPASSWORD") != "" {
+			w.logger.noticef("password is not retrieved as -w takes precedence, and psql uses PGPASSWORD already set")
+		}
+		return env, nil
+	}
+	// Lets the command prompt for the password the user wants to type
+	if opts.forcePrompt {
+		w.logger.debugf("password is not retrieved as prompting is forced")
+		return env, nil
+	}
+	// Lets the command read the password file chosen by the user
+	if info.Passfile != "" {
+		w.logger.debugf("password is not retrieved as the password file \"%s\" is given", info.Passfile)
+		return env, nil
+	}
+	// Keeps the password given by the user
+	if os.Getenv("PGPASSWORD") != "" {
+		w.logger.debugf("PGPASSWORD is already set and kept")
+		return env, nil
+	}
+	w.prefetchPasswords(ctx, info)
+	if info.User == "" && !w.canAskForUser(info) {
+		w.logger.debugf("Cannot detect username to login")
+	} else if w.isSkippedUser(info.User) {
+		w.logger.debugf("password is not retrieved for user \"%s\"", info.User)
+	} else if sources["user"] == sourceOSUser && !w.hasPasswordProviders(info) {
+		// The login name is only a guess, which should not require the provider
+		w.logger.debugf("password is not retrieved for the login name \"%s\" as no provider is configured", info.User)
 	} else {
-		var password, err = w.retrievePasswordForUser(username)
+		var cred, err = w.retrievePasswordForUser(ctx, info)
 		if err != nil {
 			return env, err
 		}
-		if password != "" {
-			env = append(env, fmt.Sprintf("PGPASSWORD=%s", password))
+		env = appendSettings(env, cred.settings)
+		if cred.username != "" && canOverrideUser(sources) {
+			info.User = cred.username
+			env = append(env, fmt.Sprintf("PGUSER=%s", cred.username))
+		}
+		if cred.password != "" {
+			return w.supplyPassword(env, info, cred.password)
 		}
 	}
 	return env, nil
 }
 
-func (w *wrapper) runCommand(command string, args []string, env []string) (int, error) {
+// Returns true if the provider may be invoked without the username, and return it along with the password.
+// This is always allowed for the service, or also for the host or database if PGW_ALLOW_EMPTY_USER is 1.
+func (w *wrapper) canAskForUser(info conninfo.ConnInfo) bool {
+	if info.Service != "" {
+		return true
+	}
+	return w.getenv("PGW_ALLOW_EMPTY_USER") == "1" && (info.Host != "" || info.Dbname != "")
+}
 
-	var cmd = exec.Command(command, args...)
+// Returns true if the user returned by the provider takes effect through PGUSER,
+// i.e. the user is not specified on the command line nor in the service file
+func canOverrideUser(sources conninfo.Sources) bool {
+	switch sources["user"] {
+	case "", conninfo.SourceEnv, sourcePassfile, sourceOSUser:
+		return true
+	}
+	return false
+}
+
+// Retrieves the passwords for the users listed in PGW_PREFETCH_USERS, separated by commas,
+// to populate the cache. Failures are only logged.
+func (w *wrapper) prefetchPasswords(ctx context.Context, info conninfo.ConnInfo) {
+	for _, user := range strings.Split(w.getenv("PGW_PREFETCH_USERS"), ",") {
+		if user = strings.TrimSpace(user); user == "" || w.isSkippedUser(user) {
+			continue
+		}
+		var target = info
+		target.User = user
+		if _, err := w.retrievePasswordForUser(ctx, target); err != nil {
+			w.logger.warnf("failed to prefetch the password for user \"%s\": %v", user, err)
+		}
+	}
+}
+
+// Returns false if no providers are configured nor found in the default locations
+func (w *wrapper) hasPasswordProviders(info conninfo.ConnInfo) bool {
+	var _, err = w.selectPasswordProviders(info)
+	return !errors.Is(err, errNoPasswordProvider)
+}
+
+// Returns true if the user is listed in PGW_SKIP_USERS, e.g. the one authenticated by peer or IAM
+func (w *wrapper) isSkippedUser(username string) bool {
+	for _, skipped := range strings.Split(w.getenv("PGW_SKIP_USERS"), ",") {
+		if skipped != "" && skipped == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *wrapper) supplyPassword(env []string, info conninfo.ConnInfo, password string) ([]string, error) {
+	if w.getenv("PGW_PROMPT_FEED") == "1" && isTerminal(os.Stdin) {
+		w.promptPassword = password
+		return env, nil
+	}
+	if w.getenv("PGW_USE_PASSFILE") == "1" {
+		var path, err = w.writeTempPassfile(info, password)
+		if err != nil {
+			return env, err
+		}
+		return append(env, fmt.Sprintf("PGPASSFILE=%s", path)), nil
+	}
+	return append(env, fmt.Sprintf("PGPASSWORD=%s", password)), nil
+}
+
+func (w *wrapper) removeTempFiles() {
+	for _, path := range w.tempFiles {
+		if err := os.Remove(path); err != nil {
+			w.logger.warnf("%v", err)
+		}
+	}
+	w.tempFiles = nil
+}
+
+func (w *wrapper) runCommand(ctx context.Context, command string, args []string, env []string) (int, error) {
+
+	var cmd = exec.CommandContext(ctx, command, args...)
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 	cmd.Env = env
 
-	err := cmd.Run()
+	defer catchBrokenPipe()()
+
+	var err error
+	if w.promptPassword != "" {
+		err = w.runWithPromptFeed(cmd, w.promptPassword)
+	} else {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = w.run(cmd)
+	}
 	switch err := err.(type) {
 	case nil:
 		return 0, nil
 	case *exec.ExitError:
-		return cmd.ProcessState.ExitCode(), nil
+		return exitCodeOf(cmd.ProcessState), nil
 	default:
 		return 1, err
 	}
 }
 
-func (w *wrapper) searchForUsername(args []string) string {
-	var username = w.searchArgsForUsername(args)
-	if username == "" {
-		username = os.Getenv("PGUSER")
+func (w *wrapper) run(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
 	}
-	return username
+	var stop = w.relaySignals(cmd.Process)
+	defer stop()
+	return cmd.Wait()
 }
 
-var shortOptionsHavingArg = map[byte]bool{
-	'c': true,
-	'd': true,
-	'f': true,
-	'V': true,
-	'?': true,
-	'F': true,
-	'R': true,
-	'T': true,
-	'h': true,
-	'p': true,
-	'U': true,
+// Returns the parser for the command, which records the options about the password in opts
+func (w *wrapper) newParser(opts *passwordOptions) conninfo.Parser {
+	var userOption = w.getenv("PGW_USER_OPTION")
+	return conninfo.Parser{
+		Command:    w.command,
+		UserOption: userOption,
+		OnOption: func(name string, value string) {
+			switch name {
+			case "-w", "--no-password":
+				opts.noPassword = true
+			case "-W", "--password":
+				opts.forcePrompt = true
+			case "-U", "--username", userOption:
+				opts.resetUser = value == ""
+			case "-V", "--version", "-?", "--help":
+				opts.noConnection = true
+			}
+		},
+		OnWarning: func(message string) {
+			w.logger.warnf("%s", message)
+		},
+	}
 }
 
-var longOptionsHavingArg = map[string]bool{
-	"command":          true,
-	"dbname":           true,
-	"file":             true,
-	"set":              true,
-	"variable":         true,
-	"help":             true,
-	"log-file":         true,
-	"output":           true,
-	"field-separator":  true,
-	"pset":             true,
-	"record-separator": true,
-	"table-attr":       true,
-	"host":             true,
-	"port":             true,
-	"username":         true,
+func (w *wrapper) searchForConnInfo(args []string) (conninfo.ConnInfo, conninfo.Sources, passwordOptions) {
+	var opts passwordOptions
+	var parser = w.newParser(&opts)
+	var info, sources, err = parser.ParseWithSources(args)
+	if err != nil {
+		w.logger.warnf("%v", err)
+	}
+	// Parameters not given by the arguments are taken from the environment as libpq does
+	var envParams = []struct {
+		keyword string
+		name    string
+		value   *string
+	}{
+		{"user", "PGUSER", &info.User},
+		{"host", "PGHOST", &info.Host},
+		{"port", "PGPORT", &info.Port},
+		{"dbname", "PGDATABASE", &info.Dbname},
+		{"passfile", "PGPASSFILE", &info.Passfile},
+	}
+	for _, param := range envParams {
+		if param.keyword == "user" && opts.resetUser {
+			continue
+		}
+		if *param.value == "" {
+			if *param.value = os.Getenv(param.name); *param.value != "" {
+				sources[param.keyword] = conninfo.SourceEnv
+			}
+		}
+	}
+	// Validated as the parser does for the port given in the arguments
+	if sources["port"] == conninfo.SourceEnv && !conninfo.IsValidPort(info.Port) {
+		w.logger.warnf("invalid port \"%s\" in PGPORT ignored", info.Port)
+		info.Port = ""
+		delete(sources, "port")
+	}
+	// The password is selected for the first host
+	info = info.Primary()
+	if info.User == "" && !opts.resetUser {
+		if info.User = w.searchPassfileForUser(info); info.User != "" {
+			sources["user"] = sourcePassfile
+		}
+	}
+	// Falls back to the login name as libpq does, unless the provider can tell the user
+	if info.User == "" && !w.canAskForUser(info) && w.getenv("PGW_NO_OSUSER_FALLBACK") != "1" {
+		if info.User = osUsername(); info.User != "" {
+			sources["user"] = sourceOSUser
+		}
+	}
+	w.logger.debugf("detected %s", describeConnInfo(info, sources))
+	return info, sources, opts
 }
 
-func (w *wrapper) searchArgsForUsername(args []string) string {
-	var username string
-	var positional []string
+// Source of the username found in the password file
+const sourcePassfile conninfo.Source = "passfile"
 
-	for i := 0; i < len(args); i++ {
+// Source of the username which is the login name of the current user
+const sourceOSUser conninfo.Source = "os"
 
-		var arg string = args[i]
+// Returns the login name of the current user, without the domain on Windows
+func osUsername() string {
+	var current, err = user.Current()
+	if err != nil {
+		return ""
+	}
+	var name = current.Username
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
 
-		if isLongOption(arg) {
+// Describes the parameters with their sources, e.g. user "alice" (arg)
+func describeConnInfo(info conninfo.ConnInfo, sources conninfo.Sources) string {
+	var params = []struct {
+		keyword string
+		value   string
+	}{
+		{"user", info.User},
+		{"host", info.Host},
+		{"port", info.Port},
+		{"dbname", info.Dbname},
+	}
+	var descriptions = make([]string, len(params))
+	for i, param := range params {
+		if param.value == "" {
+			descriptions[i] = fmt.Sprintf("%s unspecified", param.keyword)
+		} else {
+			descriptions[i] = fmt.Sprintf("%s \"%s\" (%s)", param.keyword, param.value, sources[param.keyword])
+		}
+	}
+	return strings.Join(descriptions, ", ")
+}
 
-			if len(arg) <= 2 {
-				continue
-			}
+// Options on the command line which affect how the password is supplied
+type passwordOptions struct {
+	// -w or --no-password
+	noPassword bool
+	// -W or --password
+	forcePrompt bool
+	// -U or --username with an empty value, which resets the username
+	resetUser bool
+	// -V, --version, -? or --help, with which the command does not connect
+	noConnection bool
+}
 
-			var value string
-			kv := strings.SplitN(arg[2:], "=", 2)
-			longName := kv[0]
-			if len(kv) >= 2 {
-				value = kv[1]
-			} else if longOptionsHavingArg[longName] {
-				if i+1 < len(args) {
-					i++
-					value = args[i]
-				}
-			}
+func (w *wrapper) retrievePasswordForUser(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	var key = passwordKeyFor(info)
+	if cred, found := w.credentials[key]; found {
+		w.writeAuditLog(info, "", "cached", nil)
+		return cred, nil
+	}
+	ttl, err := w.getDuration("PGW_CACHE_TTL", 0)
+	if err != nil {
+		return credential{}, err
+	}
+	if ttl > 0 {
+		if cred, found := w.loadCachedCredential(key, ttl); found {
+			w.logger.debugf("password for user \"%s\" is found in the cache", info.User)
+			w.redactor.addSecret(cred.password)
+			w.credentials[key] = cred
+			w.writeAuditLog(info, "", "cached", nil)
+			return cred, nil
+		}
+	}
+	cred, provider, err := w.fetchPassword(ctx, info)
+	w.writeAuditLog(info, provider, auditResult(cred, err), err)
+	if err != nil {
+		return credential{}, err
+	}
+	w.redactor.addSecret(cred.password)
+	w.credentials[key] = cred
+	if ttl > 0 && cred.password != "" {
+		w.storeCachedCredential(key, cred, ttl)
+	}
+	return cred, nil
+}
 
-			if longName == "username" {
-				username = value
-			}
+// Fetches the password from the selected providers,
+// and returns the credential along with the name of the provider which answered last
+func (w *wrapper) fetchPassword(ctx context.Context, info conninfo.ConnInfo) (credential, string, error) {
+	// ConnInfo never holds the password
+	w.logger.debugf("retrieving the password for %s", info)
+	var providers, err = w.selectPasswordProviders(info)
+	if err != nil {
+		return credential{}, "", err
+	}
+	// Lets the command proceed without the password if no provider has it
+	var last string
+	for _, provider := range providers {
+		last = provider.name()
+		var found, err = provider.lookup(ctx, info)
+		if errors.Is(err, errPasswordNotFound) {
+			continue
+		}
+		if err != nil {
+			return credential{}, last, err
+		}
+		return found, last, nil
+	}
+	return credential{}, last, nil
+}
 
-		} else if isShortOption(arg) {
+// Exit code of the provider indicating no password is stored for the user
+const notFoundExitCode = 2
 
-			if len(arg) <= 1 {
-				continue
-			}
+// Exit code of the provider indicating a temporary failure, EX_TEMPFAIL in sysexits.h
+const tempFailExitCode = 75
 
-			shortName := arg[1]
+var errPasswordNotFound = errors.New("password not found")
 
-			var value string
-			if len(arg) > 2 {
-				value = arg[2:]
-			} else if shortOptionsHavingArg[shortName] {
-				if i+1 < len(args) {
-					i++
-					value = args[i]
-				}
-			}
+const initialRetryDelay = 200 * time.Millisecond
 
-			if shortName == 'U' {
-				username = value
-			}
+// Provider invoked as an external command
+type execProvider struct {
+	w    *wrapper
+	path string
+}
+
+func (p *execProvider) name() string {
+	return p.path
+}
+
+func (p *execProvider) lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	var cred, err = p.w.invokePasswordProviderWithRetry(ctx, p.path, info)
+	if err == nil && cred.password == "" {
+		return credential{}, errPasswordNotFound
+	}
+	return cred, err
+}
+
+// Invokes the provider again while it fails temporarily, up to the number of retries
+func (w *wrapper) invokePasswordProviderWithRetry(ctx context.Context, provider string, info conninfo.ConnInfo) (credential, error) {
+	var retries, err = w.getProviderRetries()
+	if err != nil {
+		return credential{}, err
+	}
+	var delay = initialRetryDelay
+	for attempt := 0; ; attempt++ {
+		var cred, err = w.invokePasswordProvider(ctx, provider, info)
+		var exitErr *exec.ExitError
+		if err == nil || attempt >= retries || !errors.As(err, &exitErr) || exitErr.ExitCode() != tempFailExitCode {
+			return cred, err
+		}
+		w.logger.infof("password provider \"%s\" failed temporarily, retrying in %s", provider, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return credential{}, fmt.Errorf("password provider \"%s\" canceled", provider)
+		}
+		delay *= 2
+	}
+}
 
+func (w *wrapper) invokePasswordProvider(ctx context.Context, provider string, info conninfo.ConnInfo) (credential, error) {
+	var timeout, err = w.getProviderTimeout()
+	if err != nil {
+		return credential{}, err
+	}
+	proto, err := w.getProviderProto()
+	if err != nil {
+		return credential{}, err
+	}
+	if err := checkExecutable(provider); err != nil {
+		return credential{}, err
+	}
+	var cancel = context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	defer w.logProviderTime(provider, time.Now())
+
+	var cmd = commandContext(ctx, provider, w.getProviderArgs(info)...)
+	if isTerminal(os.Stdin) {
+		// Lets the provider prompt on the terminal, e.g. to unlock the secret store.
+		// It stays in the foreground process group to read the terminal,
+		// so only the provider itself is killed on timeout.
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+	} else {
+		// Kills also the descendants of the provider on timeout
+		killProcessGroupOnCancel(cmd)
+	}
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(w.providerEnviron(),
+		fmt.Sprintf("PGW_COMMAND=%s", w.command),
+		fmt.Sprintf("PGW_HOST=%s", info.Host),
+		fmt.Sprintf("PGW_PORT=%s", info.Port),
+		fmt.Sprintf("PGW_DBNAME=%s", info.Dbname),
+		fmt.Sprintf("PGW_SERVICE=%s", info.Service),
+		fmt.Sprintf("PGW_SSLMODE=%s", info.SSLMode),
+	)
+	stdout, err := cmd.Output()
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return credential{}, fmt.Errorf("password provider \"%s\" timed out after %s", provider, timeout)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return credential{}, fmt.Errorf("password provider \"%s\" canceled", provider)
+	}
+	switch err := err.(type) {
+	case nil:
+		switch proto {
+		case providerProtoLength:
+			return parseLengthPrefixedOutput(provider, stdout)
+		case providerProtoEnv:
+			return w.parseEnvOutput(provider, stdout)
+		}
+		return w.parseProviderOutput(provider, stdout)
+	case *exec.ExitError:
+		if err.ExitCode() == notFoundExitCode {
+			return credential{}, errPasswordNotFound
+		}
+		w.logProviderStderr(err.Stderr, err.ExitCode() == tempFailExitCode)
+		return credential{}, fmt.Errorf("password provider \"%s\" exited with an error: %w", provider, err)
+	default:
+		return credential{}, fmt.Errorf("failed to invoke the password provider: %w", err)
+	}
+}
+
+// Logs the standard error captured from the failed provider, at info level if it will be retried
+func (w *wrapper) logProviderStderr(stderr []byte, temporary bool) {
+	var lines = strings.Split(strings.TrimRight(string(stderr), "\r\n"), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if temporary {
+			w.logger.infof("provider: %s", strings.TrimRight(line, "\r"))
 		} else {
-			positional = append(positional, arg)
+			w.logger.errorf("provider: %s", strings.TrimRight(line, "\r"))
 		}
 	}
+}
+
+const defaultProviderTimeout = 10 * time.Second
+
+// Returns the timeout for the password provider, or zero if disabled
+func (w *wrapper) getProviderTimeout() (time.Duration, error) {
+	return w.getDuration("PGW_PROVIDER_TIMEOUT", defaultProviderTimeout)
+}
 
-	if found := w.searchPositionalArgsForUsername(positional, username); found != "" {
-		username = found
+// Returns the non-negative duration in the variable, which is in seconds if a plain number
+func (w *wrapper) getDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	var value = w.getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
 	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return duration, nil
+	}
+	return 0, fmt.Errorf("invalid %s \"%s\"", name, value)
+}
 
-	return username
+func (w *wrapper) getProviderRetries() (int, error) {
+	var value = w.getenv("PGW_PROVIDER_RETRIES")
+	if value == "" {
+		return 0, nil
+	}
+	if retries, err := strconv.Atoi(value); err == nil && retries >= 0 {
+		return retries, nil
+	}
+	return 0, fmt.Errorf("invalid PGW_PROVIDER_RETRIES \"%s\"", value)
 }
 
-func (w *wrapper) searchPositionalArgsForUsername(args []string, username string) string {
-	var maxArgs = 2
-	if username != "" {
-		maxArgs = 1
+// Returns the environment inherited by the provider,
+// which is limited to the variables listed in PGW_PROVIDER_ENV_ALLOW, separated by commas, if set
+func (w *wrapper) providerEnviron() []string {
+	var allow = w.getenv("PGW_PROVIDER_ENV_ALLOW")
+	if allow == "" {
+		return os.Environ()
 	}
-	for i, arg := range args {
-		switch {
-		case i >= maxArgs:
-			w.logger.Printf("extra command-line argument \"%s\" ignored", arg)
-		case i == 0:
-			username = w.searchConnectionArgForUsername(args[0])
-		case i == 1:
-			username = arg
+	var env []string
+	for _, name := range strings.Split(allow, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if value, found := os.LookupEnv(name); found {
+			env = append(env, name+"="+value)
 		}
 	}
-	return username
+	return env
+}
+
+// Formats of the output of the provider selected by PGW_PROVIDER_PROTO
+const (
+	// The password or the JSON object, with the surrounding spaces removed
+	providerProtoLine = "line"
+	// The length of the password as 4-byte big-endian integer, followed by the password as is
+	providerProtoLength = "length"
+	// Lines of the form KEY=VALUE setting PGPASSWORD and the other environment variables of libpq
+	providerProtoEnv = "env"
+)
+
+func (w *wrapper) getProviderProto() (string, error) {
+	switch value := w.getenv("PGW_PROVIDER_PROTO"); value {
+	case "":
+		return providerProtoLine, nil
+	case providerProtoLine, providerProtoLength, providerProtoEnv:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid PGW_PROVIDER_PROTO \"%s\"", value)
+	}
 }
 
-func (w *wrapper) searchConnectionArgForUsername(arg string) string {
-	if strings.HasPrefix(arg, "postgresql:") {
-		return w.searchConnectionURIForUsername(arg)
+// Exit code when the password cannot be supplied to the command, EX_CONFIG in sysexits.h
+const providerErrorExitCode = 78
+
+// Returns the exit code given by PGW_PROVIDER_ERROR_EXIT for a failure of the provider or the configuration
+func (w *wrapper) providerErrorExitCode() int {
+	var value = w.getenv("PGW_PROVIDER_ERROR_EXIT")
+	if value == "" {
+		return providerErrorExitCode
+	}
+	if code, err := strconv.Atoi(value); err == nil && code >= 1 && code <= 255 {
+		return code
+	}
+	w.logger.errorf("invalid PGW_PROVIDER_ERROR_EXIT \"%s\"", value)
+	return providerErrorExitCode
+}
+
+// Logs the time taken by the provider since the start, at debug level unless --psqlw-timing is given
+func (w *wrapper) logProviderTime(provider string, start time.Time) {
+	var elapsed = time.Since(start).Round(time.Millisecond)
+	if w.timing {
+		w.logger.printf("password provider \"%s\" took %s", provider, elapsed)
 	} else {
-		return w.searchConnectionStringForUsername(arg)
+		w.logger.debugf("password provider \"%s\" took %s", provider, elapsed)
 	}
 }
 
-func (w *wrapper) searchConnectionURIForUsername(uri string) string {
-	var u, err = url.Parse(uri)
-	if err != nil {
-		w.logger.Println(err)
-		return ""
+// Returns the arguments added to the command by PGW_EXTRA_ARGS,
+// which is either a JSON array of strings or a list separated by spaces
+func (w *wrapper) getExtraArgs() ([]string, error) {
+	var value = strings.TrimSpace(w.getenv("PGW_EXTRA_ARGS"))
+	if !strings.HasPrefix(value, "[") {
+		return strings.Fields(value), nil
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(value), &args); err != nil {
+		return nil, fmt.Errorf("invalid PGW_EXTRA_ARGS \"%s\": %w", value, err)
 	}
-	return u.User.Username()
+	return args, nil
 }
 
-func (w *wrapper) searchConnectionStringForUsername(s string) string {
-	var re = regexp.MustCompile(`\s+`)
-	var params = re.Split(s, -1)
-	for _, param := range params {
-		var kv = strings.SplitN(param, "=", 2)
-		if len(kv) == 2 && kv[0] == "user" {
-			return strings.TrimSpace(kv[1])
-		}
+// Returns the arguments for the provider expanded from PGW_PROVIDER_ARGS, or the username by default.
+// The template is split by spaces before expansion, so the values are never split nor interpreted by a shell.
+func (w *wrapper) getProviderArgs(info conninfo.ConnInfo) []string {
+	var template = w.getenv("PGW_PROVIDER_ARGS")
+	if template == "" {
+		return []string{info.User}
 	}
-	return ""
+	var replacer = placeholderReplacer(info, nil)
+	var args = strings.Fields(template)
+	for i, arg := range args {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
 }
 
-func (w *wrapper) retrievePasswordForUser(username string) (string, error) {
-	var provider = w.getPasswordProvider()
-	if provider == "" {
-		return "", errors.New("environment variable PGW_PASSWORD_PROVIDER is undefined")
+// Returns the replacer of the placeholders like {user} with the values escaped by the function if given
+func placeholderReplacer(info conninfo.ConnInfo, escape func(string) string) *strings.Replacer {
+	if escape == nil {
+		escape = func(s string) string { return s }
 	}
-	return w.invokePasswordProvider(provider, username)
+	return strings.NewReplacer(
+		"{user}", escape(info.User),
+		"{host}", escape(info.Host),
+		"{port}", escape(info.Port),
+		"{dbname}", escape(info.Dbname),
+		"{service}", escape(info.Service),
+	)
 }
 
-func (w *wrapper) invokePasswordProvider(provider string, username string) (string, error) {
-	var cmd = exec.Command(provider, username)
-	var stdout, err = cmd.Output()
-	switch err := err.(type) {
-	case nil:
-		// Removes trailing new lines
-		password := strings.TrimRight(string(stdout), "\n")
-		return password, nil
-	case *exec.ExitError:
-		return "", fmt.Errorf("password provider \"%s\" exited with an error: %w", provider, err)
-	default:
-		return "", fmt.Errorf("failed to invoke the password provider: %w", err)
+// Returns the providers to be tried in order
+func (w *wrapper) getPasswordProviders(host string) ([]string, error) {
+	var setting, _ = w.passwordProviderSetting(host)
+	var providers []string
+	for _, provider := range filepath.SplitList(setting) {
+		if provider != "" {
+			providers = append(providers, provider)
+		}
+	}
+	// The default provider may be disabled not to run a file dropped next to the wrapper
+	if len(providers) == 0 && w.getenv("PGW_DISABLE_DEFAULT_PROVIDER") != "1" {
+		var path, err = w.findDefaultPasswordProvider()
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			providers = append(providers, path)
+		}
 	}
+	return providers, nil
 }
 
-func (w *wrapper) getPasswordProvider() string {
-	var provider = os.Getenv("PGW_PASSWORD_PROVIDER")
-	if provider == "" {
-		var path = filepath.Join(filepath.Dir(w.path), defaultPasswordProvider)
-		if _, err := os.Stat(path); err == nil {
-			provider = path
+func (w *wrapper) findDefaultPasswordProvider() (string, error) {
+	for _, path := range w.defaultPasswordProviderPaths() {
+		for _, candidate := range executableCandidates(path) {
+			if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+				// Anyone who can modify the file can run any command as the user
+				if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+					return "", fmt.Errorf("password provider \"%s\" is writable by group or others (mode %04o); run chmod go-w", candidate, info.Mode().Perm())
+				}
+				return candidate, nil
+			}
 		}
 	}
-	return provider
+	return "", nil
 }
 
-func isShortOption(arg string) bool {
-	return strings.HasPrefix(arg, "-")
+// Returns the absolute path of the directory containing the wrapper
+func (w *wrapper) executableDir() string {
+	var path = w.path
+	// Invoked through PATH
+	if filepath.Base(path) == path {
+		if found, err := exec.LookPath(path); err == nil {
+			path = found
+		}
+	}
+	var dir = filepath.Dir(path)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return dir
 }
 
-func isLongOption(arg string) bool {
-	return strings.HasPrefix(arg, "--")
+// Returns the paths where the default provider is searched for, in order
+func (w *wrapper) defaultPasswordProviderPaths() []string {
+	var name = w.getenv("PGW_DEFAULT_PROVIDER_NAME")
+	if name == "" {
+		name = defaultPasswordProvider
+	}
+	var paths = []string{filepath.Join(w.executableDir(), name)}
+	for _, dir := range w.configDirs() {
+		paths = append(paths, filepath.Join(dir, "provider"))
+	}
+	return paths
 }
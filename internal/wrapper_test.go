@@ -0,0 +1,1452 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/openclosed-dev/psql-wrapper/pkg/conninfo"
+)
+
+// Returns the wrapper of psql writing the log messages to the returned buffer,
+// with the environment cleared of the variables affecting the wrapper
+func newTestWrapper(t *testing.T) (*wrapper, *bytes.Buffer) {
+	t.Helper()
+	clearEnv(t)
+	var out bytes.Buffer
+	var w = newWrapper("psqlw")
+	w.redactor = newRedactor(&out)
+	w.logger = newLeveledLogger(w.redactor, "psqlw", defaultLogLevel)
+	w.command = "psql"
+	w.path = filepath.Join(t.TempDir(), "psqlw")
+	return w, &out
+}
+
+// Unsets the variables of libpq and the wrapper, and replaces the home and the standard input,
+// so that neither the files nor the terminal of the user affect the tests
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, entry := range os.Environ() {
+		var name, _, _ = strings.Cut(entry, "=")
+		if strings.HasPrefix(name, "PG") || strings.HasPrefix(name, "VAULT_") || strings.HasPrefix(name, "AWS_") ||
+			name == "CREDENTIALS_DIRECTORY" {
+			// Restored after the test
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	var home = t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+
+	var stdin, err = os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved = os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() {
+		os.Stdin = saved
+		stdin.Close()
+	})
+}
+
+// Writes the shell script into the directory, and returns its path
+func writeScript(t *testing.T, dir string, name string, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not run on Windows")
+	}
+	var path = filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Writes the provider running the body, and returns its path along with the file
+// to which the arguments of each invocation are appended as a line
+func writeProvider(t *testing.T, body string) (string, string) {
+	t.Helper()
+	var dir = t.TempDir()
+	var calls = filepath.Join(dir, "calls")
+	var path = writeScript(t, dir, "provider", fmt.Sprintf("echo \"$*\" >> '%s'\n%s", calls, body))
+	return path, calls
+}
+
+// Returns the arguments of the invocations recorded by the provider written by writeProvider
+func invocations(t *testing.T, calls string) []string {
+	t.Helper()
+	var data, err = os.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRetrievePasswordForUserInvokesProviderOnce(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider, calls = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales"}
+	for i := 0; i < 2; i++ {
+		var cred, err = w.retrievePasswordForUser(context.Background(), info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.password != "secret" {
+			t.Errorf("password = %q, want %q", cred.password, "secret")
+		}
+	}
+	if got := invocations(t, calls); len(got) != 1 {
+		t.Errorf("provider invoked %d times, want once", len(got))
+	}
+
+	// Another database is another key
+	info.Dbname = "hr"
+	if _, err := w.retrievePasswordForUser(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+	if got := invocations(t, calls); len(got) != 2 {
+		t.Errorf("provider invoked %d times, want twice", len(got))
+	}
+}
+
+// Returns the values of the variable in the environment
+func lookupEnv(env []string, name string) []string {
+	var values []string
+	for _, entry := range env {
+		if n, value, _ := strings.Cut(entry, "="); n == name {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func TestBuildEnvSkipsProviderForNoPassword(t *testing.T) {
+	for _, flag := range []string{"-w", "--no-password"} {
+		t.Run(flag, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, calls = writeProvider(t, "echo secret\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+			var env, err = w.buildEnv(context.Background(), []string{flag, "-U", "alice", "sales"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lookupEnv(env, "PGPASSWORD"); len(got) != 0 {
+				t.Errorf("PGPASSWORD = %q, want none", got)
+			}
+			if got := invocations(t, calls); len(got) != 0 {
+				t.Errorf("provider invoked %d times, want never", len(got))
+			}
+			// The flag takes no value
+			if info, _, _ := w.searchForConnInfo([]string{flag, "sales"}); info.Dbname != "sales" {
+				t.Errorf("dbname = %q, want %q", info.Dbname, "sales")
+			}
+		})
+	}
+}
+
+func TestBuildEnvKeepsPGPASSWORD(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	w.logger.level = levelDebug
+	var provider, calls = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	t.Setenv("PGPASSWORD", "given")
+
+	var env, err = w.buildEnv(context.Background(), []string{"-U", "alice", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != "given" {
+		t.Errorf("PGPASSWORD = %q, want only %q", got, "given")
+	}
+	if got := invocations(t, calls); len(got) != 0 {
+		t.Errorf("provider invoked %d times, want never", len(got))
+	}
+	if !strings.Contains(out.String(), "PGPASSWORD is already set and kept") {
+		t.Errorf("log = %q, want the message that PGPASSWORD is kept", out.String())
+	}
+}
+
+// Body of the provider failing temporarily the given times before returning the password
+func failingProvider(failures int) string {
+	return fmt.Sprintf("if [ $(wc -l < \"$(dirname \"$0\")/calls\") -le %d ]; then exit 75; fi\necho secret\n", failures)
+}
+
+func TestInvokePasswordProviderWithRetry(t *testing.T) {
+	var tests = []struct {
+		name     string
+		body     string
+		retries  string
+		password string
+		calls    int
+		fails    bool
+	}{
+		{"succeeds after retries", failingProvider(2), "3", "secret", 3, false},
+		{"runs out of retries", failingProvider(2), "1", "", 2, true},
+		{"no retries by default", failingProvider(1), "", "", 1, true},
+		{"fatal error not retried", "exit 1\n", "3", "", 1, true},
+		{"not found not retried", "exit 2\n", "3", "", 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, calls = writeProvider(t, test.body)
+			t.Setenv("PGW_PROVIDER_RETRIES", test.retries)
+
+			var cred, err = w.invokePasswordProviderWithRetry(context.Background(), provider, conninfo.ConnInfo{User: "alice"})
+			if test.fails != (err != nil) {
+				t.Errorf("error = %v, want failure %v", err, test.fails)
+			}
+			if cred.password != test.password {
+				t.Errorf("password = %q, want %q", cred.password, test.password)
+			}
+			if got := invocations(t, calls); len(got) != test.calls {
+				t.Errorf("provider invoked %d times, want %d", len(got), test.calls)
+			}
+		})
+	}
+}
+
+func TestBuildEnvByProviderResult(t *testing.T) {
+	var tests = []struct {
+		name     string
+		body     string
+		password []string
+		fails    bool
+	}{
+		{"password", "echo secret\n", []string{"secret"}, false},
+		{"empty output", "exit 0\n", nil, false},
+		{"not found", "echo 'no such user' >&2\nexit 2\n", nil, false},
+		{"error", "exit 1\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, _ = writeProvider(t, test.body)
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+			var env, err = w.buildEnv(context.Background(), []string{"-U", "alice", "sales"})
+			if test.fails != (err != nil) {
+				t.Errorf("error = %v, want failure %v", err, test.fails)
+			}
+			if got := lookupEnv(env, "PGPASSWORD"); strings.Join(got, ",") != strings.Join(test.password, ",") {
+				t.Errorf("PGPASSWORD = %q, want %q", got, test.password)
+			}
+		})
+	}
+}
+
+func TestInvokePasswordProviderNotFound(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider, _ = writeProvider(t, "exit 2\n")
+	var _, err = w.invokePasswordProvider(context.Background(), provider, conninfo.ConnInfo{User: "alice"})
+	if !errors.Is(err, errPasswordNotFound) {
+		t.Errorf("error = %v, want %v", err, errPasswordNotFound)
+	}
+}
+
+func TestFetchPasswordFromChain(t *testing.T) {
+	var tests = []struct {
+		name     string
+		first    string
+		password string
+		fails    bool
+		// Whether the second provider is invoked
+		second bool
+	}{
+		{"falls through not found", "exit 2\n", "second", false, true},
+		{"falls through empty", "exit 0\n", "second", false, true},
+		{"stops at password", "echo first\n", "first", false, false},
+		{"stops at error", "exit 1\n", "", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var first, _ = writeProvider(t, test.first)
+			var second, calls = writeProvider(t, "echo second\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", first+string(filepath.ListSeparator)+second)
+
+			var cred, _, err = w.fetchPassword(context.Background(), conninfo.ConnInfo{User: "alice"})
+			if test.fails != (err != nil) {
+				t.Errorf("error = %v, want failure %v", err, test.fails)
+			}
+			if cred.password != test.password {
+				t.Errorf("password = %q, want %q", cred.password, test.password)
+			}
+			if got := len(invocations(t, calls)) > 0; got != test.second {
+				t.Errorf("second provider invoked = %v, want %v", got, test.second)
+			}
+		})
+	}
+}
+
+func TestLaunchEReturnsError(t *testing.T) {
+	clearEnv(t)
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		{nil, "no arguments given"},
+		{[]string{"psqlw", "--psqlw-unknown"}, "unknown option \"--psqlw-unknown\""},
+		{[]string{"psqlw", "--psqlw-check-provider"}, "requires a username"},
+	}
+	for _, test := range tests {
+		var code, err = LaunchE("psqlw", "psql", test.args)
+		if code == 0 || err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("LaunchE(%q) = %d, %v, want non-zero and %q", test.args, code, err, test.want)
+		}
+	}
+}
+
+func TestGetPasswordProvidersSearchesDefaultLocations(t *testing.T) {
+	var tests = []struct {
+		name string
+		// Paths of the providers relative to the directory of the wrapper, XDG_CONFIG_HOME, and the home
+		files []string
+		// Default provider name given by PGW_DEFAULT_PROVIDER_NAME
+		defaultName string
+		want        string
+	}{
+		{"next to wrapper", []string{"bin/password_provider", "xdg/psqlw/provider"}, "", "bin/password_provider"},
+		{"custom name", []string{"bin/password_provider", "bin/pgpass-helper"}, "pgpass-helper", "bin/pgpass-helper"},
+		{"XDG_CONFIG_HOME", []string{"xdg/psqlw/provider", "home/.config/psqlw/provider"}, "", "xdg/psqlw/provider"},
+		{"home", []string{"home/.config/psqlw/provider"}, "", "home/.config/psqlw/provider"},
+		{"none", nil, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var root = t.TempDir()
+			w.path = filepath.Join(root, "bin", "psqlw")
+			t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "xdg"))
+			t.Setenv("HOME", filepath.Join(root, "home"))
+			t.Setenv("PGW_DEFAULT_PROVIDER_NAME", test.defaultName)
+			for _, file := range test.files {
+				var path = filepath.Join(root, filepath.FromSlash(file))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeScript(t, filepath.Dir(path), filepath.Base(path), "echo secret\n")
+			}
+
+			var providers, err = w.getPasswordProviders("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			if test.want != "" {
+				want = []string{filepath.Join(root, filepath.FromSlash(test.want))}
+			}
+			if strings.Join(providers, ",") != strings.Join(want, ",") {
+				t.Errorf("providers = %q, want %q", providers, want)
+			}
+		})
+	}
+}
+
+func TestSearchForConnInfoUserPrecedence(t *testing.T) {
+	var login = osUsername()
+	var tests = []struct {
+		name   string
+		args   []string
+		pguser string
+		user   string
+		source conninfo.Source
+	}{
+		{"option over all", []string{"-U", "alice", "postgresql://bob@db.example.com/sales"}, "carol", "alice", conninfo.SourceArg},
+		{"positional over env", []string{"sales", "alice"}, "carol", "alice", conninfo.SourceArg},
+		{"URI over env", []string{"postgresql://bob@db.example.com/sales"}, "carol", "bob", conninfo.SourceURI},
+		{"connection string over env", []string{"user=bob dbname=sales"}, "carol", "bob", conninfo.SourceConnString},
+		{"empty user in connection string", []string{"user='' dbname=sales"}, "carol", "carol", conninfo.SourceEnv},
+		{"URI without user", []string{"postgresql://db.example.com/sales"}, "carol", "carol", conninfo.SourceEnv},
+		{"env over login name", []string{"sales"}, "carol", "carol", conninfo.SourceEnv},
+		{"login name", []string{"sales"}, "", login, sourceOSUser},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			t.Setenv("PGUSER", test.pguser)
+			var info, sources, _ = w.searchForConnInfo(test.args)
+			if info.User != test.user {
+				t.Errorf("user = %q, want %q", info.User, test.user)
+			}
+			if test.user != "" && sources["user"] != test.source {
+				t.Errorf("source = %q, want %q", sources["user"], test.source)
+			}
+		})
+	}
+}
+
+func TestSearchForConnInfoValidatesPortFromEnv(t *testing.T) {
+	var tests = []struct {
+		pgport  string
+		port    string
+		warning string
+	}{
+		{"6432", "6432", ""},
+		{"5432,6432", "5432", ""},
+		{"0", "", "invalid port \"0\" in PGPORT ignored"},
+		{"abc", "", "invalid port \"abc\" in PGPORT ignored"},
+		{"5432,99999", "", "invalid port \"5432,99999\" in PGPORT ignored"},
+	}
+	for _, test := range tests {
+		var w, out = newTestWrapper(t)
+		w.logger.level = levelWarn
+		t.Setenv("PGPORT", test.pgport)
+		var info, sources, _ = w.searchForConnInfo([]string{"sales"})
+		if info.Port != test.port {
+			t.Errorf("port of PGPORT=%q = %q, want %q", test.pgport, info.Port, test.port)
+		}
+		if _, found := sources["port"]; found != (test.port != "") {
+			t.Errorf("source of the port of PGPORT=%q = %q", test.pgport, sources["port"])
+		}
+		if got := strings.Contains(out.String(), "invalid port"); got != (test.warning != "") || !strings.Contains(out.String(), test.warning) {
+			t.Errorf("log of PGPORT=%q = %q, want %q", test.pgport, out.String(), test.warning)
+		}
+	}
+}
+
+func TestBuildEnvSkipsListedUsers(t *testing.T) {
+	var tests = []struct {
+		user    string
+		skipped bool
+	}{
+		{"iam_reader", true},
+		{"peer", true},
+		{"IAM_READER", false},
+		{"alice", false},
+	}
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, calls = writeProvider(t, "echo secret\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGW_SKIP_USERS", "iam_reader,peer")
+
+			var env, err = w.buildEnv(context.Background(), []string{"-U", test.user, "sales"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(lookupEnv(env, "PGPASSWORD")) == 0; got != test.skipped {
+				t.Errorf("PGPASSWORD = %q, want skipped %v", lookupEnv(env, "PGPASSWORD"), test.skipped)
+			}
+			if got := len(invocations(t, calls)) == 0; got != test.skipped {
+				t.Errorf("provider invoked %d times, want skipped %v", len(invocations(t, calls)), test.skipped)
+			}
+		})
+	}
+}
+
+func TestSearchForConnInfoLogsSources(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	w.logger.level = levelDebug
+	t.Setenv("PGHOST", "db.example.com")
+
+	w.searchForConnInfo([]string{"postgresql://alice@/sales?port=6432"})
+	var want = `detected user "alice" (uri), host "db.example.com" (env), port "6432" (uri), dbname "sales" (uri)`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("log = %q, want %q", out.String(), want)
+	}
+}
+
+func TestCheckProvider(t *testing.T) {
+	var tests = []struct {
+		name string
+		body string
+		code int
+		want string
+	}{
+		{"ok", "echo secret\n", 0, "psqlw: ok\n"},
+		{"not found", "exit 2\n", 1, "no password found for user \"alice\""},
+		{"error", "exit 1\n", 1, "exited with an error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, out = newTestWrapper(t)
+			var provider, calls = writeProvider(t, test.body)
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+			var code, err = w.checkProvider(context.Background(), "alice", []string{"-U", "bob", "sales"})
+			if code != test.code {
+				t.Errorf("exit code = %d, want %d", code, test.code)
+			}
+			if err != nil {
+				out.WriteString(err.Error())
+			}
+			if !strings.Contains(out.String(), test.want) || strings.Contains(out.String(), "secret") {
+				t.Errorf("output = %q, want %q without the password", out.String(), test.want)
+			}
+			if got := invocations(t, calls); len(got) != 1 || got[0] != "alice" {
+				t.Errorf("provider invoked with %q, want the user given to the option", got)
+			}
+		})
+	}
+}
+
+func TestBuildEnvWithUserFromProvider(t *testing.T) {
+	var tests = []struct {
+		name   string
+		args   []string
+		pguser string
+		want   []string
+	}{
+		{"option wins", []string{"-U", "alice", "sales"}, "", nil},
+		{"URI wins", []string{"postgresql://alice@db.example.com/sales"}, "", nil},
+		{"provider wins over env", []string{"sales"}, "alice", []string{"svc_sales"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, _ = writeProvider(t, `echo '{"username": "svc_sales", "password": "secret"}'`+"\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGUSER", test.pguser)
+
+			var env, err = w.buildEnv(context.Background(), test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lookupEnv(env, "PGUSER"); strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("PGUSER = %q, want %q", got, test.want)
+			}
+			if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != "secret" {
+				t.Errorf("PGPASSWORD = %q, want %q", got, "secret")
+			}
+		})
+	}
+}
+
+func TestGetProviderArgs(t *testing.T) {
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "my sales; $(rm -rf ~)", Service: "analytics"}
+	var tests = []struct {
+		template string
+		want     []string
+	}{
+		{"", []string{"alice"}},
+		{"get --user={user} --host={host}:{port}", []string{"get", "--user=alice", "--host=db.example.com:5432"}},
+		// The values are neither split nor interpreted
+		{"  lookup  {dbname} ", []string{"lookup", "my sales; $(rm -rf ~)"}},
+		{"{service} {unknown}", []string{"analytics", "{unknown}"}},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		t.Setenv("PGW_PROVIDER_ARGS", test.template)
+		if got := w.getProviderArgs(info); strings.Join(got, "\x00") != strings.Join(test.want, "\x00") {
+			t.Errorf("args of %q = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestProviderTimingIsLoggedOnlyWhenEnabled(t *testing.T) {
+	var tests = []struct {
+		name   string
+		timing bool
+		level  logLevel
+		logged bool
+	}{
+		{"disabled", false, defaultLogLevel, false},
+		{"--psqlw-timing", true, defaultLogLevel, true},
+		{"debug level", false, levelDebug, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, out = newTestWrapper(t)
+			w.timing = test.timing
+			w.logger.level = test.level
+			var provider, _ = writeProvider(t, "echo secret\n")
+
+			if _, err := w.invokePasswordProvider(context.Background(), provider, conninfo.ConnInfo{User: "alice"}); err != nil {
+				t.Fatal(err)
+			}
+			var logged = strings.Contains(out.String(), fmt.Sprintf("password provider \"%s\" took ", provider))
+			if logged != test.logged {
+				t.Errorf("log = %q, want the timing line %v", out.String(), test.logged)
+			}
+		})
+	}
+}
+
+func TestSearchForConnInfoFromEnvOnly(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGUSER", "alice")
+	t.Setenv("PGHOST", "db.example.com")
+	t.Setenv("PGPORT", "6432")
+	t.Setenv("PGDATABASE", "sales")
+
+	var info, sources, _ = w.searchForConnInfo(nil)
+	if want := (conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "6432", Dbname: "sales"}); info != want {
+		t.Errorf("detected %+v, want %+v", info, want)
+	}
+	for _, keyword := range []string{"user", "host", "port", "dbname"} {
+		if sources[keyword] != conninfo.SourceEnv {
+			t.Errorf("source of %s = %q, want %q", keyword, sources[keyword], conninfo.SourceEnv)
+		}
+	}
+
+	// The arguments win over the environment
+	info, sources, _ = w.searchForConnInfo([]string{"-h", "replica.example.com", "hr"})
+	if want := (conninfo.ConnInfo{User: "alice", Host: "replica.example.com", Port: "6432", Dbname: "hr"}); info != want {
+		t.Errorf("detected %+v, want %+v", info, want)
+	}
+	if sources["host"] != conninfo.SourceArg || sources["port"] != conninfo.SourceEnv {
+		t.Errorf("sources = %v, want host from the argument and port from the environment", sources)
+	}
+}
+
+func TestBuildEnvSkipsProviderForPrompt(t *testing.T) {
+	for _, flag := range []string{"-W", "--password"} {
+		t.Run(flag, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, calls = writeProvider(t, "echo secret\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+			var env, err = w.buildEnv(context.Background(), []string{flag, "sales", "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lookupEnv(env, "PGPASSWORD"); len(got) != 0 {
+				t.Errorf("PGPASSWORD = %q, want none", got)
+			}
+			if got := invocations(t, calls); len(got) != 0 {
+				t.Errorf("provider invoked %d times, want never", len(got))
+			}
+			// The flag takes no value
+			if info, _, _ := w.searchForConnInfo([]string{flag, "sales", "alice"}); info.Dbname != "sales" || info.User != "alice" {
+				t.Errorf("detected %+v, want dbname and user", info)
+			}
+		})
+	}
+}
+
+func TestLaunchWithEmptyArgs(t *testing.T) {
+	clearEnv(t)
+	for _, args := range [][]string{nil, {}} {
+		var code, err = LaunchE("psqlw", "psql", args)
+		if code != 1 || err == nil || err.Error() != "no arguments given, not even the program name" {
+			t.Errorf("LaunchE(%q) = %d, %v, want 1 and the error", args, code, err)
+		}
+	}
+}
+
+// Writes the provider saving its environment, and returns its path along with the environment read after invoked
+func writeEnvProvider(t *testing.T) (string, func() []string) {
+	t.Helper()
+	var provider, _ = writeProvider(t, "env > \"$(dirname \"$0\")/env\"\necho secret\n")
+	return provider, func() []string {
+		var data, err = os.ReadFile(filepath.Join(filepath.Dir(provider), "env"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+}
+
+func TestProviderReceivesCommand(t *testing.T) {
+	for _, command := range []string{"psql", "pg_dump"} {
+		var w, _ = newTestWrapper(t)
+		w.command = command
+		var provider, providerEnv = writeEnvProvider(t)
+
+		var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales", SSLMode: "require"}
+		if _, err := w.invokePasswordProvider(context.Background(), provider, info); err != nil {
+			t.Fatal(err)
+		}
+		var env = providerEnv()
+		for name, want := range map[string]string{
+			"PGW_COMMAND": command,
+			"PGW_HOST":    "db.example.com",
+			"PGW_PORT":    "5432",
+			"PGW_DBNAME":  "sales",
+			"PGW_SSLMODE": "require",
+		} {
+			if got := lookupEnv(env, name); len(got) != 1 || got[0] != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	}
+}
+
+// Returns what the function writes to the standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	var file, err = os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var saved = os.Stdout
+	os.Stdout = file
+	defer func() { os.Stdout = saved }()
+	f()
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLaunchPrintsVersion(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var saved = version
+	version = "v1.2.3"
+	defer func() { version = saved }()
+	// The command is never run
+	t.Setenv("PGW_PSQL_PATH", filepath.Join(t.TempDir(), "missing"))
+
+	var code int
+	var err error
+	var output = captureStdout(t, func() {
+		code, err = w.launch(context.Background(), "psql", []string{"--psqlw-version", "-V"})
+	})
+	if code != 0 || err != nil {
+		t.Errorf("exit code = %d, %v, want 0", code, err)
+	}
+	if output != "psqlw v1.2.3\n" {
+		t.Errorf("output = %q, want %q", output, "psqlw v1.2.3\n")
+	}
+
+	version = ""
+	if got := wrapperVersion(); got == "" {
+		t.Errorf("version is empty without the one set at build time")
+	}
+}
+
+func TestFetchPasswordLogsConnectionString(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	w.logger.level = levelDebug
+	var provider, _ = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Dbname: "my sales"}
+	if _, _, err := w.fetchPassword(context.Background(), info); err != nil {
+		t.Fatal(err)
+	}
+	if want := "retrieving the password for user=alice host=db.example.com dbname='my sales'"; !strings.Contains(out.String(), want) {
+		t.Errorf("log = %q, want %q", out.String(), want)
+	}
+}
+
+// Writes the fake psql recording its arguments, one per line, and its environment,
+// and returns the functions reading them after run
+func writeCommand(t *testing.T) (func() []string, func() []string) {
+	t.Helper()
+	var dir = t.TempDir()
+	var command = writeScript(t, dir, "psql", fmt.Sprintf("printf '%%s\\n' \"$@\" > '%s/args'\nenv > '%s/env'\n", dir, dir))
+	t.Setenv("PGW_PSQL_PATH", command)
+	var read = func(name string) []string {
+		var data, err = os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	return func() []string { return read("args") }, func() []string { return read("env") }
+}
+
+func TestLaunchWithExtraArgs(t *testing.T) {
+	var tests = []struct {
+		name  string
+		extra string
+		want  []string
+	}{
+		{"words", "--set=ON_ERROR_STOP=1 -X", []string{"--set=ON_ERROR_STOP=1", "-X", "-c", "select 1", "sales"}},
+		{"JSON array", `["--set=ON_ERROR_STOP=1", "--pset=title=daily report"]`, []string{"--set=ON_ERROR_STOP=1", "--pset=title=daily report", "-c", "select 1", "sales"}},
+		{"none", "", []string{"-c", "select 1", "sales"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var args, _ = writeCommand(t)
+			var provider, _ = writeProvider(t, "echo secret\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGW_EXTRA_ARGS", test.extra)
+
+			if code, err := w.launch(context.Background(), "psql", []string{"-c", "select 1", "sales"}); code != 0 || err != nil {
+				t.Fatalf("exit code = %d, %v", code, err)
+			}
+			if got := args(); strings.Join(got, "\x00") != strings.Join(test.want, "\x00") {
+				t.Errorf("args = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLaunchWithInvalidExtraArgs(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_EXTRA_ARGS", `["-X"`)
+	if code, err := w.launch(context.Background(), "psql", []string{"sales"}); err == nil || code != providerErrorExitCode {
+		t.Errorf("exit code = %d, %v, want %d and the error", code, err, providerErrorExitCode)
+	}
+}
+
+func TestGetPasswordProvidersWithDefaultDisabled(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	writeScript(t, filepath.Dir(w.path), defaultPasswordProvider, "echo secret\n")
+	t.Setenv("PGW_DISABLE_DEFAULT_PROVIDER", "1")
+
+	if providers, err := w.getPasswordProviders(""); err != nil || len(providers) != 0 {
+		t.Errorf("providers = %q, %v, want none", providers, err)
+	}
+	// The provider configured explicitly is still used
+	var provider, _ = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	if providers, err := w.getPasswordProviders(""); err != nil || len(providers) != 1 || providers[0] != provider {
+		t.Errorf("providers = %q, %v, want %q", providers, err, provider)
+	}
+}
+
+func TestDefaultProviderWritableByOthersIsRefused(t *testing.T) {
+	for _, mode := range []os.FileMode{0777, 0775, 0757} {
+		var w, _ = newTestWrapper(t)
+		var path = writeScript(t, filepath.Dir(w.path), defaultPasswordProvider, "echo secret\n")
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		var providers, err = w.getPasswordProviders("")
+		var want = fmt.Sprintf("password provider \"%s\" is writable by group or others (mode %04o); run chmod go-w", path, mode)
+		if err == nil || err.Error() != want {
+			t.Errorf("providers = %q, %v, want the error %q", providers, err, want)
+		}
+	}
+}
+
+func TestLaunchPrintsUser(t *testing.T) {
+	var tests = []struct {
+		name   string
+		args   []string
+		pguser string
+		want   string
+	}{
+		{"arg", []string{"-U", "alice", "sales"}, "carol", "alice\n"},
+		{"URI", []string{"postgresql://bob@db.example.com/sales"}, "carol", "bob\n"},
+		{"env", []string{"sales"}, "carol", "carol\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, calls = writeProvider(t, "echo secret\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGUSER", test.pguser)
+
+			var code int
+			var err error
+			var output = captureStdout(t, func() {
+				code, err = w.launch(context.Background(), "psql", append([]string{"--psqlw-print-user"}, test.args...))
+			})
+			if code != 0 || err != nil || output != test.want {
+				t.Errorf("printed %q, %d, %v, want %q", output, code, err, test.want)
+			}
+			if got := invocations(t, calls); len(got) != 0 {
+				t.Errorf("provider invoked %d times, want never", len(got))
+			}
+		})
+	}
+}
+
+func TestLaunchPrintsNoUser(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_NO_OSUSER_FALLBACK", "1")
+	var code int
+	var err error
+	var output = captureStdout(t, func() {
+		code, err = w.launch(context.Background(), "psql", []string{"--psqlw-print-user", "sales"})
+	})
+	if code != 1 || err == nil || output != "" {
+		t.Errorf("printed %q, %d, %v, want the error", output, code, err)
+	}
+}
+
+func TestProviderStderrIsLoggedOnFailure(t *testing.T) {
+	var tests = []struct {
+		name   string
+		code   string
+		level  logLevel
+		logged bool
+	}{
+		{"success", "0", defaultLogLevel, false},
+		{"failure", "1", defaultLogLevel, true},
+		{"temporary failure", "75", defaultLogLevel, false},
+		{"temporary failure at info level", "75", levelInfo, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, out = newTestWrapper(t)
+			w.logger.level = test.level
+			var provider, _ = writeProvider(t, "echo secret\necho 'vault: permission denied' >&2\necho 'token expired' >&2\nexit "+test.code+"\n")
+
+			w.invokePasswordProvider(context.Background(), provider, conninfo.ConnInfo{User: "alice"})
+			var logged = strings.Contains(out.String(), "psqlw: provider: vault: permission denied\npsqlw: provider: token expired\n")
+			if logged != test.logged {
+				t.Errorf("log = %q, want the stderr of the provider %v", out.String(), test.logged)
+			}
+		})
+	}
+}
+
+func TestBuildEnvPrefetchesPasswords(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	w.logger.level = levelWarn
+	var provider, calls = writeProvider(t, "if [ \"$1\" = bob ]; then exit 1; fi\necho \"pw-$1\"\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	t.Setenv("PGW_PREFETCH_USERS", "carol, bob,,alice,postgres")
+	t.Setenv("PGW_SKIP_USERS", "postgres")
+
+	var env, err = w.buildEnv(context.Background(), []string{"-U", "alice", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != "pw-alice" {
+		t.Errorf("PGPASSWORD = %q, want %q", got, "pw-alice")
+	}
+	// The password of alice is taken from the prefetched ones
+	if got, want := strings.Join(invocations(t, calls), ","), "carol,bob,alice"; got != want {
+		t.Errorf("provider invoked for %q, want %q", got, want)
+	}
+	var cred, found = w.credentials[passwordKeyFor(conninfo.ConnInfo{User: "carol", Dbname: "sales"})]
+	if !found || cred.password != "pw-carol" {
+		t.Errorf("password of carol = %q, want %q cached", cred.password, "pw-carol")
+	}
+	if !strings.Contains(out.String(), "psqlw: failed to prefetch the password for user \"bob\"") {
+		t.Errorf("log = %q, want the failure for bob", out.String())
+	}
+}
+
+func TestBuildEnvWithEmptyUser(t *testing.T) {
+	var tests = []struct {
+		name   string
+		allow  string
+		args   []string
+		calls  int
+		pguser string
+	}{
+		{"host", "1", []string{"-h", "db"}, 1, "svc_db"},
+		{"dbname", "1", []string{"sales"}, 1, "svc_"},
+		{"not allowed", "", []string{"-h", "db"}, 0, ""},
+		{"nothing known", "1", nil, 0, ""},
+		{"service", "", []string{"service=analytics"}, 1, "svc_analytics.example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, calls = writeProvider(t, `echo "{\"username\": \"svc_$PGW_HOST\", \"password\": \"secret\"}"`+"\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGW_NO_OSUSER_FALLBACK", "1")
+			t.Setenv("PGW_ALLOW_EMPTY_USER", test.allow)
+			var services = filepath.Join(t.TempDir(), "pg_service.conf")
+			if err := os.WriteFile(services, []byte("[analytics]\nhost=analytics.example.com\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PGSERVICEFILE", services)
+
+			var env, err = w.buildEnv(context.Background(), test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The user is passed empty
+			if got := invocations(t, calls); len(got) != test.calls || (len(got) > 0 && got[0] != "") {
+				t.Errorf("provider invoked with %q, want %d times without the user", got, test.calls)
+			}
+			if got := lookupEnv(env, "PGUSER"); strings.Join(got, ",") != test.pguser {
+				t.Errorf("PGUSER = %q, want %q", got, test.pguser)
+			}
+		})
+	}
+}
+
+// Returns the arguments saved by the fake command into the file "args" in the directory
+func readArgs(t *testing.T, dir string) string {
+	t.Helper()
+	var data, err = os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+// Provider answering the password for the user, which records the parameters looked up
+type stubProvider struct {
+	lookups []conninfo.ConnInfo
+}
+
+func (p *stubProvider) name() string {
+	return "stub"
+}
+
+func (p *stubProvider) lookup(ctx context.Context, info conninfo.ConnInfo) (credential, error) {
+	p.lookups = append(p.lookups, info)
+	if info.User == "nobody" {
+		return credential{}, errPasswordNotFound
+	}
+	return credential{password: "pw-" + info.User}, nil
+}
+
+func TestSelectPasswordProviders(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGW_PASSWORD_PROVIDER", "/opt/psqlw/first"+string(os.PathListSeparator)+"/opt/psqlw/second")
+	var describe = func() string {
+		var providers, err = w.selectPasswordProviders(conninfo.ConnInfo{User: "alice"})
+		if err != nil {
+			return err.Error()
+		}
+		var names []string
+		for _, provider := range providers {
+			switch p := provider.(type) {
+			case *execProvider:
+				names = append(names, "exec "+p.path)
+			case *socketProvider:
+				names = append(names, "socket "+p.path)
+			default:
+				names = append(names, p.name())
+			}
+		}
+		return strings.Join(names, ", ")
+	}
+	if got, want := describe(), "exec /opt/psqlw/first, exec /opt/psqlw/second"; got != want {
+		t.Errorf("providers = %q, want %q", got, want)
+	}
+	t.Setenv("PGW_PROVIDER_SOCKET", "/run/psqlw.sock")
+	if got, want := describe(), "socket /run/psqlw.sock"; got != want {
+		t.Errorf("providers = %q, want %q", got, want)
+	}
+	t.Setenv("PGW_PROVIDER", "aws-secrets")
+	if got, want := describe(), "aws-secrets"; got != want {
+		t.Errorf("providers = %q, want %q", got, want)
+	}
+	t.Setenv("PGW_PROVIDER", "lastpass")
+	if got, want := describe(), "unknown password provider \"lastpass\" in PGW_PROVIDER"; got != want {
+		t.Errorf("providers = %q, want %q", got, want)
+	}
+}
+
+func TestRetrievePasswordDispatchesToProvider(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var stub = &stubProvider{}
+	builtinProviders["stub"] = func(w *wrapper) passwordProvider { return stub }
+	defer delete(builtinProviders, "stub")
+	t.Setenv("PGW_PROVIDER", "stub")
+
+	var info = conninfo.ConnInfo{User: "alice", Host: "db.example.com", Dbname: "sales"}
+	var cred, err = w.retrievePasswordForUser(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.password != "pw-alice" {
+		t.Errorf("password = %q, want %q", cred.password, "pw-alice")
+	}
+	if len(stub.lookups) != 1 || stub.lookups[0] != info {
+		t.Errorf("lookups = %+v, want %+v", stub.lookups, info)
+	}
+
+	info.User = "nobody"
+	if cred, err := w.retrievePasswordForUser(context.Background(), info); err != nil || cred.password != "" {
+		t.Errorf("credential = %+v, %v, want no password", cred, err)
+	}
+}
+
+func TestLaunchExitCodeOnProviderError(t *testing.T) {
+	var tests = []struct {
+		name     string
+		provider string
+		psql     string
+		exit     string
+		code     int
+		err      bool
+	}{
+		{"provider fails", "exit 1\n", "exit 0\n", "", providerErrorExitCode, true},
+		{"configured", "exit 1\n", "exit 0\n", "90", 90, true},
+		{"invalid", "exit 1\n", "exit 0\n", "256", providerErrorExitCode, true},
+		{"psql fails", "echo secret\n", "exit 1\n", "90", 1, false},
+		{"psql exits with the same code", "echo secret\n", "exit 78\n", "", 78, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, out = newTestWrapper(t)
+			t.Setenv("PGW_PSQL_PATH", writeScript(t, t.TempDir(), "psql", test.psql))
+			var provider, _ = writeProvider(t, test.provider)
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGW_PROVIDER_ERROR_EXIT", test.exit)
+
+			var code, err = w.launch(context.Background(), "psql", []string{"-U", "alice", "sales"})
+			if code != test.code || (err != nil) != test.err {
+				t.Errorf("exit code = %d, %v, want %d", code, err, test.code)
+			}
+			if logged := strings.Contains(out.String(), "invalid PGW_PROVIDER_ERROR_EXIT \"256\""); logged != (test.exit == "256") {
+				t.Errorf("log = %q", out.String())
+			}
+		})
+	}
+}
+
+func TestBuildEnvWithCustomUserOption(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	w.command = "pgbench"
+	var provider, calls = writeProvider(t, "echo \"pw-$1\"\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	t.Setenv("PGW_USER_OPTION", "--connect-user")
+
+	var env, err = w.buildEnv(context.Background(), []string{"-c", "10", "--connect-user", "alice", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != "pw-alice" {
+		t.Errorf("PGPASSWORD = %q, want %q", got, "pw-alice")
+	}
+	if got := invocations(t, calls); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("provider invoked with %q, want alice", got)
+	}
+	if info, sources, _ := w.searchForConnInfo([]string{"--connect-user=bob"}); info.User != "bob" || sources["user"] != conninfo.SourceArg {
+		t.Errorf("user = %q from %q, want bob from the argument", info.User, sources["user"])
+	}
+}
+
+func TestBuildEnvSkipsProviderForPassfile(t *testing.T) {
+	var tests = []struct {
+		name     string
+		args     []string
+		passfile string
+	}{
+		{"connection string", []string{"user=alice dbname=sales passfile=/home/alice/.pgpass.sales"}, ""},
+		{"URI", []string{"postgresql://alice@db.example.com/sales?passfile=/home/alice/.pgpass.sales"}, ""},
+		{"PGPASSFILE", []string{"-U", "alice", "sales"}, "/home/alice/.pgpass.sales"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, out = newTestWrapper(t)
+			w.logger.level = levelDebug
+			var provider, calls = writeProvider(t, "echo secret\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGPASSFILE", test.passfile)
+
+			var env, err = w.buildEnv(context.Background(), test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lookupEnv(env, "PGPASSWORD"); len(got) != 0 {
+				t.Errorf("PGPASSWORD = %q, want none", got)
+			}
+			if got := invocations(t, calls); len(got) != 0 {
+				t.Errorf("provider invoked %d times, want never", len(got))
+			}
+			if want := "password is not retrieved as the password file \"/home/alice/.pgpass.sales\" is given"; !strings.Contains(out.String(), want) {
+				t.Errorf("log = %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestLaunchEchoesCommandLine(t *testing.T) {
+	var w, out = newTestWrapper(t)
+	var args, env = writeCommand(t)
+	var provider, _ = writeProvider(t, "echo 's3cret pass'\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+	var code, err = w.launch(context.Background(), "psql", []string{"--psqlw-echo", "-U", "alice", "-c", "select 1", "sales"})
+	if code != 0 || err != nil {
+		t.Fatalf("exit code = %d, %v", code, err)
+	}
+	var want = fmt.Sprintf("psqlw: PGPASSWORD='***' %s -U alice -c 'select 1' sales\n", os.Getenv("PGW_PSQL_PATH"))
+	if got := out.String(); got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+	// The command still runs with the password
+	if got := args(); strings.Join(got, " ") != "-U alice -c select 1 sales" {
+		t.Errorf("args = %q, want those without --psqlw-echo", got)
+	}
+	if got := lookupEnv(env(), "PGPASSWORD"); len(got) != 1 || got[0] != "s3cret pass" {
+		t.Errorf("PGPASSWORD = %q, want %q", got, "s3cret pass")
+	}
+}
+
+func TestSearchForConnInfoWithUserReset(t *testing.T) {
+	var tests = []struct {
+		args   []string
+		user   string
+		source conninfo.Source
+		reset  bool
+	}{
+		{[]string{"--username=", "sales"}, "", "", true},
+		{[]string{"-U", "", "sales"}, "", "", true},
+		// Nor is the positional one taken
+		{[]string{"--username=", "sales", "carol"}, "", "", true},
+		{[]string{"--username=", "-U", "alice", "sales"}, "alice", conninfo.SourceArg, false},
+		{[]string{"-U", "alice", "--username=", "sales"}, "", "", true},
+		{[]string{"sales"}, "bob", conninfo.SourceEnv, false},
+	}
+	for _, test := range tests {
+		var w, _ = newTestWrapper(t)
+		t.Setenv("PGUSER", "bob")
+		t.Setenv("PGW_NO_OSUSER_FALLBACK", "1")
+		var info, sources, opts = w.searchForConnInfo(test.args)
+		if info.User != test.user || sources["user"] != test.source || opts.resetUser != test.reset {
+			t.Errorf("%q: user = %q from %q, reset %v, want %q from %q, reset %v",
+				test.args, info.User, sources["user"], opts.resetUser, test.user, test.source, test.reset)
+		}
+	}
+
+	// Falls back to the login name as psql does
+	t.Setenv("PGW_NO_OSUSER_FALLBACK", "")
+	var w, _ = newTestWrapper(t)
+	t.Setenv("PGUSER", "bob")
+	if info, sources, _ := w.searchForConnInfo([]string{"--username=", "sales"}); info.User != osUsername() || sources["user"] != sourceOSUser {
+		t.Errorf("user = %q from %q, want the login name", info.User, sources["user"])
+	}
+}
+
+func TestProviderReceivesDbname(t *testing.T) {
+	var tests = []struct {
+		name       string
+		args       []string
+		pgdatabase string
+		want       string
+	}{
+		{"-d", []string{"-U", "alice", "-d", "sales"}, "", "sales"},
+		{"--dbname", []string{"-U", "alice", "--dbname=sales"}, "", "sales"},
+		{"first positional", []string{"sales", "alice"}, "", "sales"},
+		{"URI path", []string{"postgresql://alice@db.example.com/sales"}, "", "sales"},
+		{"keyword", []string{"user=alice dbname=sales"}, "", "sales"},
+		{"-d as a connection string", []string{"-d", "user=alice dbname=sales"}, "", "sales"},
+		{"-d as a URI", []string{"-d", "postgresql://alice@db.example.com/sales"}, "", "sales"},
+		{"service", []string{"-U", "alice", "service=analytics"}, "", "warehouse"},
+		{"PGDATABASE", []string{"-U", "alice"}, "sales", "sales"},
+		// The positional argument is the user when -d is given
+		{"-d with positional", []string{"-d", "hr", "alice"}, "", "hr"},
+		{"-d over PGDATABASE", []string{"-U", "alice", "-d", "hr"}, "sales", "hr"},
+		{"keyword over service", []string{"-U", "alice", "service=analytics dbname=hr"}, "", "hr"},
+		{"none", []string{"-U", "alice"}, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var provider, env = writeEnvProvider(t)
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+			t.Setenv("PGDATABASE", test.pgdatabase)
+			var services = filepath.Join(t.TempDir(), "pg_service.conf")
+			if err := os.WriteFile(services, []byte("[analytics]\ndbname=warehouse\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PGSERVICEFILE", services)
+
+			if _, err := w.buildEnv(context.Background(), test.args); err != nil {
+				t.Fatal(err)
+			}
+			if got := lookupEnv(env(), "PGW_DBNAME"); len(got) != 1 || got[0] != test.want {
+				t.Errorf("PGW_DBNAME = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildEnvWithLoginName(t *testing.T) {
+	var login = osUsername()
+	if login == "" {
+		t.Skip("no login name")
+	}
+	for _, disabled := range []string{"", "1"} {
+		var w, _ = newTestWrapper(t)
+		var provider, calls = writeProvider(t, "echo secret\n")
+		t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+		t.Setenv("PGW_NO_OSUSER_FALLBACK", disabled)
+
+		var env, err = w.buildEnv(context.Background(), []string{"sales"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		if disabled == "" {
+			want = []string{login}
+		}
+		if got := invocations(t, calls); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("provider invoked with %q, want %q", got, want)
+		}
+		if got := lookupEnv(env, "PGPASSWORD"); len(got) != len(want) {
+			t.Errorf("PGPASSWORD = %q", got)
+		}
+		// The login name is left to libpq
+		if got := lookupEnv(env, "PGUSER"); len(got) != 0 {
+			t.Errorf("PGUSER = %q, want none", got)
+		}
+	}
+}
+
+func TestLaunchWithLoginNameAndNoProvider(t *testing.T) {
+	if osUsername() == "" {
+		t.Skip("no login name")
+	}
+	var w, out = newTestWrapper(t)
+	var args, env = writeCommand(t)
+
+	var code, err = w.launch(context.Background(), "psql", []string{"sales"})
+	if code != 0 || err != nil {
+		t.Fatalf("exit code = %d, %v, want the command to run", code, err)
+	}
+	if got := args(); len(got) != 1 || got[0] != "sales" {
+		t.Errorf("args = %q", got)
+	}
+	if got := lookupEnv(env(), "PGPASSWORD"); len(got) != 0 {
+		t.Errorf("PGPASSWORD = %q, want none", got)
+	}
+	if out.Len() != 0 {
+		t.Errorf("log = %q, want nothing", out.String())
+	}
+
+	// Still an error for the user given explicitly
+	if code, err := w.launch(context.Background(), "psql", []string{"-U", "alice", "sales"}); code != providerErrorExitCode || !errors.Is(err, errNoPasswordProvider) {
+		t.Errorf("exit code = %d, %v, want %d and no provider", code, err, providerErrorExitCode)
+	}
+}
+
+func TestLaunchSkipsProviderForVersionAndHelp(t *testing.T) {
+	for _, flag := range []string{"-V", "--version", "-?", "--help", "--help=variables"} {
+		t.Run(flag, func(t *testing.T) {
+			var w, _ = newTestWrapper(t)
+			var args, env = writeCommand(t)
+			var provider, calls = writeProvider(t, "echo secret\n")
+			t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+
+			if code, err := w.launch(context.Background(), "psql", []string{flag, "-U", "alice"}); code != 0 || err != nil {
+				t.Fatalf("exit code = %d, %v", code, err)
+			}
+			if got := invocations(t, calls); len(got) != 0 {
+				t.Errorf("provider invoked %d times, want never", len(got))
+			}
+			if got := args(); len(got) != 3 || got[0] != flag {
+				t.Errorf("args = %q, want %s passed", got, flag)
+			}
+			if got := lookupEnv(env(), "PGPASSWORD"); len(got) != 0 {
+				t.Errorf("PGPASSWORD = %q, want none", got)
+			}
+		})
+	}
+
+	// Not an option after "--"
+	var w, _ = newTestWrapper(t)
+	var provider, calls = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	if _, err := w.buildEnv(context.Background(), []string{"-U", "alice", "--", "-V"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := invocations(t, calls); len(got) != 1 {
+		t.Errorf("provider invoked %d times, want once", len(got))
+	}
+}
+
+func TestLaunchExplainsArguments(t *testing.T) {
+	var w, _ = newTestWrapper(t)
+	var provider, calls = writeProvider(t, "echo secret\n")
+	t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+	var dir = t.TempDir()
+	t.Setenv("PGW_PSQL_PATH", writeScript(t, dir, "psql", "touch \"$(dirname \"$0\")/run\"\n"))
+
+	var code int
+	var err error
+	var report = captureStdout(t, func() {
+		code, err = w.launch(context.Background(), "psql", []string{
+			"--psqlw-explain", "--host", "db.example.com", "-p5432", "-c", "select 1", "--username=alice", "-tA", "sales", "--", "-x"})
+	})
+	if code != 0 || err != nil {
+		t.Fatalf("exit code = %d, %v", code, err)
+	}
+	var want = `long option  --host
+option value db.example.com
+short option -p5432
+short option -c
+option value 'select 1'
+long option  --username=alice
+short option -tA
+positional   sales
+separator    --
+positional   -x
+detected     user "alice" (arg), host "db.example.com" (arg), port "5432" (arg), dbname "sales" (arg)
+`
+	if report != want {
+		t.Errorf("report = %q, want %q", report, want)
+	}
+	if got := invocations(t, calls); len(got) != 0 {
+		t.Errorf("provider invoked %d times, want never", len(got))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "run")); err == nil {
+		t.Errorf("command is run")
+	}
+}
+
+func TestBuildEnvNotesNoPasswordWithPGPASSWORD(t *testing.T) {
+	var tests = []struct {
+		pgpassword string
+		quiet      bool
+		noted      bool
+	}{
+		{"given", false, true},
+		{"given", true, false},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		var w, out = newTestWrapper(t)
+		w.logger.quiet = test.quiet
+		var provider, calls = writeProvider(t, "echo secret\n")
+		t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+		t.Setenv("PGPASSWORD", test.pgpassword)
+
+		var env, err = w.buildEnv(context.Background(), []string{"-w", "-U", "alice", "sales"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := invocations(t, calls); len(got) != 0 {
+			t.Errorf("provider invoked %d times, want never", len(got))
+		}
+		// PGPASSWORD of the user is passed as is
+		if got := lookupEnv(env, "PGPASSWORD"); len(got) != 1 || got[0] != test.pgpassword {
+			t.Errorf("PGPASSWORD = %q, want %q", got, test.pgpassword)
+		}
+		var want = "psqlw: password is not retrieved as -w takes precedence, and psql uses PGPASSWORD already set\n"
+		if noted := out.String() == want; noted != test.noted {
+			t.Errorf("log with PGPASSWORD %q, quiet %t = %q", test.pgpassword, test.quiet, out.String())
+		}
+	}
+}
+
+func TestProviderEnvironWithAllowlist(t *testing.T) {
+	for _, allow := range []string{"", "PATH, HOME,,PGW_UNSET"} {
+		var w, _ = newTestWrapper(t)
+		var provider, env = writeEnvProvider(t)
+		t.Setenv("PGW_PASSWORD_PROVIDER", provider)
+		t.Setenv("PGW_PROVIDER_ENV_ALLOW", allow)
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "not for the provider")
+		os.Unsetenv("PGW_UNSET")
+
+		if _, err := w.buildEnv(context.Background(), []string{"-U", "alice", "-h", "db.example.com", "sales"}); err != nil {
+			t.Fatal(err)
+		}
+		var got = env()
+		if secret := lookupEnv(got, "AWS_SECRET_ACCESS_KEY"); len(secret) != 0 && allow != "" {
+			t.Errorf("AWS_SECRET_ACCESS_KEY = %q, want none with the allowlist", secret)
+		} else if len(secret) != 1 && allow == "" {
+			t.Errorf("AWS_SECRET_ACCESS_KEY = %q, want inherited without the allowlist", secret)
+		}
+		if home := lookupEnv(got, "HOME"); len(home) != 1 || home[0] != os.Getenv("HOME") {
+			t.Errorf("HOME = %q, want %q", home, os.Getenv("HOME"))
+		}
+		if unset := lookupEnv(got, "PGW_UNSET"); len(unset) != 0 {
+			t.Errorf("PGW_UNSET = %q, want none", unset)
+		}
+		// The context is always passed
+		if host := lookupEnv(got, "PGW_HOST"); len(host) != 1 || host[0] != "db.example.com" {
+			t.Errorf("PGW_HOST = %q, want %q", host, "db.example.com")
+		}
+		if dbname := lookupEnv(got, "PGW_DBNAME"); len(dbname) != 1 || dbname[0] != "sales" {
+			t.Errorf("PGW_DBNAME = %q, want %q", dbname, "sales")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package conninfo detects the connection parameters
+// from the command-line arguments of PostgreSQL client applications such as psql.
+package conninfo
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ConnInfo holds the connection parameters of PostgreSQL.
+// Multiple hosts and ports are kept as comma-separated lists.
+type ConnInfo struct {
+	User   string
+	Host   string
+	Port   string
+	Dbname string
+	// Name of the service in the connection service file
+	Service string
+	SSLMode string
+	// Command-line options sent to the server
+	Options string
+	// Path of the password file
+	Passfile string
+}
+
+// Keywords of the parameters in ConnInfo
+var keywords = []string{"user", "host", "port", "dbname", "service", "sslmode", "options", "passfile"}
+
+// Source tells where a connection parameter is detected from.
+type Source string
+
+const (
+	// Command-line option or positional argument
+	SourceArg Source = "arg"
+	// Connection URI
+	SourceURI Source = "uri"
+	// Connection string in the keyword/value format
+	SourceConnString Source = "conninfo"
+	// Connection service file
+	SourceService Source = "service"
+	// Environment variable, e.g. PGSERVICE
+	SourceEnv Source = "env"
+)
+
+// Sources maps the keywords of the parameters, e.g. "user", to their sources.
+type Sources map[string]Source
+
+func (c *ConnInfo) set(keyword string, value string) {
+	switch keyword {
+	case "user":
+		c.User = value
+	case "host":
+		c.Host = value
+	case "port":
+		c.Port = value
+	case "dbname":
+		c.Dbname = value
+	case "service":
+		c.Service = value
+	case "sslmode":
+		c.SSLMode = value
+	case "options":
+		c.Options = value
+	case "passfile":
+		c.Passfile = value
+	}
+}
+
+func (c *ConnInfo) get(keyword string) string {
+	switch keyword {
+	case "user":
+		return c.User
+	case "host":
+		return c.Host
+	case "port":
+		return c.Port
+	case "dbname":
+		return c.Dbname
+	case "service":
+		return c.Service
+	case "sslmode":
+		return c.SSLMode
+	case "options":
+		return c.Options
+	case "passfile":
+		return c.Passfile
+	}
+	return ""
+}
+
+// IsValidPort returns true if each of the comma-separated ports is empty or a number from 1 to 65535.
+func IsValidPort(port string) bool {
+	for _, p := range strings.Split(port, ",") {
+		if p == "" {
+			continue
+		}
+		if strings.Trim(p, "0123456789") != "" {
+			return false
+		}
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return false
+		}
+	}
+	return true
+}
+
+// Primary returns the parameters for the first host if multiple hosts are specified.
+func (c ConnInfo) Primary() ConnInfo {
+	c.Host, _, _ = strings.Cut(c.Host, ",")
+	c.Port, _, _ = strings.Cut(c.Port, ",")
+	return c
+}
+
+// String returns the parameters as a connection string in the keyword/value format,
+// e.g. "user=alice host=localhost". Unspecified parameters are omitted.
+// ConnInfo never holds the password, so the result is safe to be logged.
+func (c ConnInfo) String() string {
+	var params []string
+	for _, keyword := range keywords {
+		if value := c.get(keyword); value != "" {
+			params = append(params, keyword+"="+quoteConnStringValue(value))
+		}
+	}
+	return strings.Join(params, " ")
+}
@@ -0,0 +1,38 @@
+package conninfo
+
+import "testing"
+
+func TestConnInfoString(t *testing.T) {
+	var tests = []struct {
+		info ConnInfo
+		want string
+	}{
+		{ConnInfo{}, ""},
+		{ConnInfo{User: "alice", Host: "db.example.com", Port: "5432", Dbname: "sales"}, "user=alice host=db.example.com port=5432 dbname=sales"},
+		{ConnInfo{User: "foo bar", Dbname: "o'brien"}, `user='foo bar' dbname='o\'brien'`},
+		{ConnInfo{User: `CORP\alice`, Options: "-c search_path=app"}, `user='CORP\\alice' options='-c search_path=app'`},
+		{ConnInfo{Host: "db1,db2", Port: "5432,5433", SSLMode: "require"}, "host=db1,db2 port=5432,5433 sslmode=require"},
+		{ConnInfo{Service: "analytics", Passfile: "/home/alice/.pgpass"}, "service=analytics passfile=/home/alice/.pgpass"},
+	}
+	for _, test := range tests {
+		var got = test.info.String()
+		if got != test.want {
+			t.Errorf("String() of %+v = %q, want %q", test.info, got, test.want)
+		}
+		// Parsed back into the same parameters
+		if parsed, err := parseConnectionString(got); err != nil || parsed != test.info {
+			t.Errorf("%q is parsed into %+v, %v, want %+v", got, parsed, err, test.info)
+		}
+	}
+}
+
+func TestConnInfoStringFromURI(t *testing.T) {
+	clearEnv(t)
+	var info, err = Parse([]string{"postgresql://alice@db1:5432,db2:5433/sales?sslmode=require"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.String(), "user=alice host=db1,db2 port=5432,5433 dbname=sales sslmode=require"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+package conninfo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parses the connection string in the keyword/value format.
+// Values may be single-quoted, and backslashes escape the following characters.
+// The parameters parsed before an error are returned along with the error.
+func parseConnectionString(s string) (ConnInfo, error) {
+	var info ConnInfo
+	var i = 0
+	for {
+		i = skipSpaces(s, i)
+		if i >= len(s) {
+			return info, nil
+		}
+
+		var start = i
+		for i < len(s) && s[i] != '=' && !isSpace(s[i]) {
+			i++
+		}
+		var keyword = s[start:i]
+
+		i = skipSpaces(s, i)
+		if i >= len(s) || s[i] != '=' {
+			return info, fmt.Errorf("missing \"=\" after \"%s\" in connection string", keyword)
+		}
+		i = skipSpaces(s, i+1)
+
+		var value strings.Builder
+		if i < len(s) && s[i] == '\'' {
+			i++
+			for {
+				if i >= len(s) {
+					return info, fmt.Errorf("unterminated quoted string in connection string")
+				}
+				if s[i] == '\'' {
+					i++
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+		} else {
+			for i < len(s) && !isSpace(s[i]) {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+		}
+
+		// Keywords are matched case-insensitively as some tools capitalize them, e.g. User=
+		info.set(strings.ToLower(keyword), value.String())
+	}
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+// Quotes the value if it contains spaces, quotes, or backslashes
+func quoteConnStringValue(value string) string {
+	if !strings.ContainsAny(value, " \t\n\v\f\r'\\") {
+		return value
+	}
+	var b strings.Builder
+	b.WriteByte('\'')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\'' || value[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(value[i])
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
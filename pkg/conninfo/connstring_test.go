@@ -0,0 +1,44 @@
+package conninfo
+
+import "testing"
+
+func TestParseConnectionString(t *testing.T) {
+	var tests = []struct {
+		s    string
+		want ConnInfo
+		fail bool
+	}{
+		{"user='foo bar' dbname=sales", ConnInfo{User: "foo bar", Dbname: "sales"}, false},
+		{`user=foo\ bar dbname=sales`, ConnInfo{User: "foo bar", Dbname: "sales"}, false},
+		{"user='' dbname=sales", ConnInfo{Dbname: "sales"}, false},
+		{`user='o\'brien' password='a b'`, ConnInfo{User: "o'brien"}, false},
+		{`user='back\\slash'`, ConnInfo{User: `back\slash`}, false},
+		{"  user = alice\thost=db.example.com  ", ConnInfo{User: "alice", Host: "db.example.com"}, false},
+		{"user='alice", ConnInfo{}, true},
+		{"user=alice dbname", ConnInfo{User: "alice"}, true},
+	}
+	for _, test := range tests {
+		var got, err = parseConnectionString(test.s)
+		if test.fail != (err != nil) {
+			t.Errorf("parseConnectionString(%q) error = %v, want failure %v", test.s, err, test.fail)
+		}
+		if got != test.want {
+			t.Errorf("parseConnectionString(%q) = %+v, want %+v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestParseConnectionStringKeywordCase(t *testing.T) {
+	var tests = []struct {
+		s    string
+		want ConnInfo
+	}{
+		{"User=Alice", ConnInfo{User: "Alice"}},
+		{"USER=ALICE Host=DB.example.com DBNAME=Sales", ConnInfo{User: "ALICE", Host: "DB.example.com", Dbname: "Sales"}},
+	}
+	for _, test := range tests {
+		if got, err := parseConnectionString(test.s); err != nil || got != test.want {
+			t.Errorf("parseConnectionString(%q) = %+v, %v, want %+v", test.s, got, err, test.want)
+		}
+	}
+}
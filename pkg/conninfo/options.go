@@ -0,0 +1,264 @@
+package conninfo
+
+// Command-line options of a client application
+type commandOptions struct {
+	shortOptionsHavingArg map[byte]bool
+	longOptionsHavingArg  map[string]bool
+	// Connection parameters given as positional arguments, in order
+	positional []string
+}
+
+var psqlOptions = commandOptions{
+	shortOptionsHavingArg: map[byte]bool{
+		'c': true,
+		'd': true,
+		'f': true,
+		'v': true,
+		'L': true,
+		'o': true,
+		'F': true,
+		'P': true,
+		'R': true,
+		'T': true,
+		'h': true,
+		'p': true,
+		'U': true,
+	},
+	longOptionsHavingArg: map[string]bool{
+		"command":          true,
+		"dbname":           true,
+		"file":             true,
+		"set":              true,
+		"variable":         true,
+		"log-file":         true,
+		"output":           true,
+		"field-separator":  true,
+		"pset":             true,
+		"record-separator": true,
+		"table-attr":       true,
+		"host":             true,
+		"port":             true,
+		"username":         true,
+	},
+	positional: []string{"dbname", "user"},
+}
+
+var pgDumpOptions = commandOptions{
+	shortOptionsHavingArg: map[byte]bool{
+		'f': true,
+		'F': true,
+		'j': true,
+		'Z': true,
+		'e': true,
+		'E': true,
+		'n': true,
+		'N': true,
+		'S': true,
+		't': true,
+		'T': true,
+		'd': true,
+		'h': true,
+		'p': true,
+		'U': true,
+	},
+	longOptionsHavingArg: map[string]bool{
+		"file":                            true,
+		"format":                          true,
+		"jobs":                            true,
+		"compress":                        true,
+		"encoding":                        true,
+		"extension":                       true,
+		"exclude-extension":               true,
+		"schema":                          true,
+		"exclude-schema":                  true,
+		"superuser":                       true,
+		"table":                           true,
+		"exclude-table":                   true,
+		"exclude-table-and-children":      true,
+		"exclude-table-data":              true,
+		"exclude-table-data-and-children": true,
+		"extra-float-digits":              true,
+		"filter":                          true,
+		"include-foreign-data":            true,
+		"lock-wait-timeout":               true,
+		"rows-per-insert":                 true,
+		"section":                         true,
+		"snapshot":                        true,
+		"table-and-children":              true,
+		"dbname":                          true,
+		"host":                            true,
+		"port":                            true,
+		"username":                        true,
+		"role":                            true,
+	},
+	positional: []string{"dbname"},
+}
+
+var pgRestoreOptions = commandOptions{
+	shortOptionsHavingArg: map[byte]bool{
+		'd': true,
+		'f': true,
+		'F': true,
+		'I': true,
+		'j': true,
+		'L': true,
+		'n': true,
+		'N': true,
+		'P': true,
+		'S': true,
+		't': true,
+		'T': true,
+		'h': true,
+		'p': true,
+		'U': true,
+	},
+	longOptionsHavingArg: map[string]bool{
+		"dbname":         true,
+		"file":           true,
+		"format":         true,
+		"index":          true,
+		"jobs":           true,
+		"use-list":       true,
+		"schema":         true,
+		"exclude-schema": true,
+		"function":       true,
+		"superuser":      true,
+		"table":          true,
+		"trigger":        true,
+		"filter":         true,
+		"section":        true,
+		"host":           true,
+		"port":           true,
+		"username":       true,
+		"role":           true,
+	},
+	// The input file is not a connection parameter
+	positional: []string{"filename"},
+}
+
+var pgDumpallOptions = commandOptions{
+	shortOptionsHavingArg: map[byte]bool{
+		'f': true,
+		'E': true,
+		'S': true,
+		'd': true,
+		'h': true,
+		'l': true,
+		'p': true,
+		'U': true,
+	},
+	longOptionsHavingArg: map[string]bool{
+		"file":               true,
+		"encoding":           true,
+		"superuser":          true,
+		"exclude-database":   true,
+		"extra-float-digits": true,
+		"filter":             true,
+		"lock-wait-timeout":  true,
+		"rows-per-insert":    true,
+		"dbname":             true,
+		"host":               true,
+		"database":           true,
+		"port":               true,
+		"username":           true,
+		"role":               true,
+	},
+}
+
+var vacuumdbOptions = commandOptions{
+	shortOptionsHavingArg: map[byte]bool{
+		'd': true,
+		'j': true,
+		'n': true,
+		'N': true,
+		'P': true,
+		't': true,
+		'h': true,
+		'p': true,
+		'U': true,
+	},
+	longOptionsHavingArg: map[string]bool{
+		"buffer-usage-limit": true,
+		"dbname":             true,
+		"jobs":               true,
+		"min-mxid-age":       true,
+		"min-xid-age":        true,
+		"schema":             true,
+		"exclude-schema":     true,
+		"parallel":           true,
+		"table":              true,
+		"host":               true,
+		"port":               true,
+		"username":           true,
+		"maintenance-db":     true,
+	},
+	positional: []string{"dbname"},
+}
+
+var createdbOptions = commandOptions{
+	shortOptionsHavingArg: map[byte]bool{
+		'D': true,
+		'E': true,
+		'l': true,
+		'O': true,
+		'S': true,
+		'T': true,
+		'h': true,
+		'p': true,
+		'U': true,
+	},
+	longOptionsHavingArg: map[string]bool{
+		"tablespace":      true,
+		"encoding":        true,
+		"locale":          true,
+		"lc-collate":      true,
+		"lc-ctype":        true,
+		"builtin-locale":  true,
+		"icu-locale":      true,
+		"icu-rules":       true,
+		"locale-provider": true,
+		"owner":           true,
+		"strategy":        true,
+		"template":        true,
+		"host":            true,
+		"port":            true,
+		"username":        true,
+		"maintenance-db":  true,
+	},
+	// The database to be created is not the one connected to
+	positional: []string{"newdb", "description"},
+}
+
+var dropdbOptions = commandOptions{
+	shortOptionsHavingArg: map[byte]bool{
+		'h': true,
+		'p': true,
+		'U': true,
+	},
+	longOptionsHavingArg: map[string]bool{
+		"host":           true,
+		"port":           true,
+		"username":       true,
+		"maintenance-db": true,
+	},
+	// The database to be dropped is not the one connected to
+	positional: []string{"dropped"},
+}
+
+var commandOptionsTable = map[string]*commandOptions{
+	"psql":       &psqlOptions,
+	"pg_dump":    &pgDumpOptions,
+	"pg_restore": &pgRestoreOptions,
+	"pg_dumpall": &pgDumpallOptions,
+	"vacuumdb":   &vacuumdbOptions,
+	"createdb":   &createdbOptions,
+	"dropdb":     &dropdbOptions,
+}
+
+// Returns the options of the command, or those of psql for unknown commands
+func optionsForCommand(command string) *commandOptions {
+	if options, found := commandOptionsTable[command]; found {
+		return options
+	}
+	return &psqlOptions
+}
@@ -0,0 +1,340 @@
+package conninfo
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Parser detects the connection parameters from command-line arguments.
+type Parser struct {
+	// Name of the client application, e.g. "pg_dump".
+	// The options of psql are assumed if empty or unknown.
+	Command string
+	// Additional option carrying the username like --username, including the leading dashes,
+	// e.g. "--connect-user" or "-u". Ignored if empty.
+	UserOption string
+	// Called for each option found in the arguments,
+	// with the name including the leading dashes, e.g. "-w" or "--no-password".
+	OnOption func(name string, value string)
+	// Called for arguments which are ignored.
+	OnWarning func(message string)
+	// Called for each argument with how it is classified, for debugging.
+	OnArgument func(arg string, kind ArgKind)
+}
+
+// ArgKind tells how a command-line argument is classified by the parser.
+type ArgKind string
+
+const (
+	// Long option, e.g. "--username" or "--username=alice"
+	ArgLongOption ArgKind = "long option"
+	// Short option or bundled short options, e.g. "-U", "-Ualice", or "-tA"
+	ArgShortOption ArgKind = "short option"
+	// Value of the preceding option, e.g. "alice" of "-U alice"
+	ArgOptionValue ArgKind = "option value"
+	// Positional argument
+	ArgPositional ArgKind = "positional"
+	// "--" after which all the arguments are positional
+	ArgSeparator ArgKind = "separator"
+)
+
+// Parse detects the connection parameters from the command-line arguments of psql,
+// excluding the command name.
+// The service may also be given by PGSERVICE environment variable.
+// If an error occurs while reading the connection service file,
+// the parameters detected from the arguments are returned along with the error.
+func Parse(args []string) (ConnInfo, error) {
+	var p Parser
+	return p.Parse(args)
+}
+
+// Parse detects the connection parameters from the command-line arguments,
+// excluding the command name.
+func (p *Parser) Parse(args []string) (ConnInfo, error) {
+	var info, _, err = p.ParseWithSources(args)
+	return info, err
+}
+
+// ParseWithSources is like Parse, but also returns where each parameter is detected from.
+func (p *Parser) ParseWithSources(args []string) (ConnInfo, Sources, error) {
+	var layers = p.parseArgs(args)
+	if service := os.Getenv("PGSERVICE"); service != "" {
+		layers = append(layers, layer{SourceEnv, ConnInfo{Service: service}})
+	}
+	var info, sources = combineLayers(layers)
+	var err error
+	if info.Service != "" {
+		var service ConnInfo
+		if service, err = searchServiceFiles(info.Service); err == nil {
+			info, sources = combineLayers(append(layers, layer{SourceService, service}))
+		}
+	}
+	if info.Port != "" && !IsValidPort(info.Port) {
+		p.warn(fmt.Sprintf("invalid port \"%s\" ignored", info.Port))
+		info.Port = ""
+		delete(sources, "port")
+	}
+	return info, sources, err
+}
+
+// Parameters detected from a single source
+type layer struct {
+	source Source
+	info   ConnInfo
+}
+
+// Combines the layers given in order of precedence
+func combineLayers(layers []layer) (ConnInfo, Sources) {
+	var info ConnInfo
+	var sources = make(Sources)
+	for _, l := range layers {
+		for _, keyword := range keywords {
+			if info.get(keyword) == "" {
+				if value := l.info.get(keyword); value != "" {
+					info.set(keyword, value)
+					sources[keyword] = l.source
+				}
+			}
+		}
+	}
+	return info, sources
+}
+
+// Maps options to the connection parameters they specify
+var shortOptionKeywords = map[byte]string{
+	'd': "dbname",
+	'h': "host",
+	'p': "port",
+	'U': "user",
+}
+
+var longOptionKeywords = map[string]string{
+	"dbname":   "dbname",
+	"host":     "host",
+	"port":     "port",
+	"username": "user",
+	// Database connected to by createdb, dropdb, and vacuumdb
+	"maintenance-db": "dbname",
+}
+
+// Returns the argument following the option at i as its value.
+// Unlike psql, the username is not taken from an argument looking like an option,
+// so that e.g. "-U -W" is not taken as the user "-W".
+func (p *Parser) optionArg(args []string, i int, name string, isUser bool) (string, bool) {
+	if i+1 >= len(args) {
+		if isUser {
+			p.warn(fmt.Sprintf("missing value for option \"%s\"", name))
+		}
+		return "", false
+	}
+	var next = args[i+1]
+	if isUser && len(next) > 1 && isShortOption(next) {
+		p.warn(fmt.Sprintf("missing value for option \"%s\", \"%s\" is not taken as the username", name, next))
+		return "", false
+	}
+	return next, true
+}
+
+func (p *Parser) isUserOption(name string) bool {
+	return p.UserOption != "" && name == p.UserOption
+}
+
+func (p *Parser) parseArgs(args []string) []layer {
+	var info ConnInfo
+	var options = optionsForCommand(p.Command)
+	var positional []string
+	// Keywords given by the options, even if empty
+	var explicit = make(map[string]bool)
+
+	for i := 0; i < len(args); i++ {
+
+		var arg string = args[i]
+
+		if arg == "--" {
+			// All the remaining arguments are positional
+			p.notifyArgument(arg, ArgSeparator)
+			for _, rest := range args[i+1:] {
+				p.notifyArgument(rest, ArgPositional)
+			}
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+
+		if isLongOption(arg) {
+
+			p.notifyArgument(arg, ArgLongOption)
+
+			if len(arg) <= 2 {
+				continue
+			}
+
+			var value string
+			kv := strings.SplitN(arg[2:], "=", 2)
+			longName := kv[0]
+			var isUser = longOptionKeywords[longName] == "user" || p.isUserOption("--"+longName)
+			if len(kv) >= 2 {
+				value = kv[1]
+			} else if options.longOptionsHavingArg[longName] || isUser {
+				if next, ok := p.optionArg(args, i, "--"+longName, isUser); ok {
+					i++
+					value = next
+					p.notifyArgument(next, ArgOptionValue)
+				} else if isUser {
+					continue
+				}
+			}
+
+			if p.isUserOption("--" + longName) {
+				info.User = value
+				explicit["user"] = true
+			} else if keyword, ok := longOptionKeywords[longName]; ok {
+				info.set(keyword, value)
+				explicit[keyword] = true
+			}
+			p.notifyOption("--"+longName, value)
+
+		} else if isShortOption(arg) {
+
+			p.notifyArgument(arg, ArgShortOption)
+
+			// Multiple options can be bundled in a single argument, e.g. -tA
+			for j := 1; j < len(arg); j++ {
+
+				shortName := arg[j]
+				var isUser = shortOptionKeywords[shortName] == "user" || p.isUserOption("-"+string(shortName))
+
+				var value string
+				if options.shortOptionsHavingArg[shortName] || isUser {
+					// The rest of the argument or the next one is the value
+					if j+1 < len(arg) {
+						value = arg[j+1:]
+					} else if next, ok := p.optionArg(args, i, "-"+string(shortName), isUser); ok {
+						i++
+						value = next
+						p.notifyArgument(next, ArgOptionValue)
+					} else if isUser {
+						break
+					}
+					j = len(arg)
+				}
+
+				if p.isUserOption("-" + string(shortName)) {
+					info.User = value
+					explicit["user"] = true
+				} else if keyword, ok := shortOptionKeywords[shortName]; ok {
+					info.set(keyword, value)
+					explicit[keyword] = true
+				}
+				p.notifyOption("-"+string(shortName), value)
+			}
+
+		} else {
+			p.notifyArgument(arg, ArgPositional)
+			positional = append(positional, arg)
+		}
+	}
+
+	// Parameters given explicitly take precedence over those in the connection string
+	var expanded, source = p.parsePositionalArgs(positional, options, &info, explicit)
+	// The value of -d or --dbname may also be a connection string or URI
+	if info.Dbname != "" && source == "" {
+		expanded, source = p.parseConnectionArg(info.Dbname)
+		info.Dbname = ""
+	}
+
+	return []layer{{SourceArg, info}, {source, expanded}}
+}
+
+// Assigns the positional arguments to the parameters not specified by options,
+// and returns the parameters in the connection string given as the database name.
+// Like psql, the positional arguments are not taken for the parameters given by the options,
+// even if the values are empty, e.g. --username=
+func (p *Parser) parsePositionalArgs(args []string, options *commandOptions, info *ConnInfo, explicit map[string]bool) (ConnInfo, Source) {
+	var expanded ConnInfo
+	var source Source
+	var keywords []string
+	for _, keyword := range options.positional {
+		if !explicit[keyword] {
+			keywords = append(keywords, keyword)
+		}
+	}
+	for i, arg := range args {
+		switch {
+		case i >= len(keywords):
+			p.warn(fmt.Sprintf("extra command-line argument \"%s\" ignored", arg))
+		case keywords[i] == "dbname":
+			expanded, source = p.parseConnectionArg(arg)
+		default:
+			info.set(keywords[i], arg)
+		}
+	}
+	return expanded, source
+}
+
+func (p *Parser) parseConnectionArg(arg string) (ConnInfo, Source) {
+	if isConnectionURI(arg) {
+		return parseConnectionURI(arg), SourceURI
+	} else if strings.Contains(arg, "=") {
+		var info, err = parseConnectionString(arg)
+		if err != nil {
+			p.warn(err.Error())
+		}
+		return info, SourceConnString
+	}
+	// Otherwise the argument just names the database
+	return ConnInfo{Dbname: arg}, SourceArg
+}
+
+// Prefixes of the connection URI accepted by libpq
+var uriPrefixes = []string{"postgresql:", "postgres:"}
+
+func isConnectionURI(arg string) bool {
+	for _, prefix := range uriPrefixes {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseConnectionURI(uri string) ConnInfo {
+	var info ConnInfo
+	var u, err = url.Parse(uri)
+	if err != nil || strings.Contains(u.Host, ",") {
+		return parseURILeniently(uri)
+	}
+	info.User = u.User.Username()
+	info.Host = u.Hostname()
+	info.Port = u.Port()
+	info.Dbname = strings.TrimPrefix(u.Path, "/")
+	setQueryParams(&info, u.Query())
+	return info
+}
+
+func (p *Parser) notifyArgument(arg string, kind ArgKind) {
+	if p.OnArgument != nil {
+		p.OnArgument(arg, kind)
+	}
+}
+
+func (p *Parser) notifyOption(name string, value string) {
+	if p.OnOption != nil {
+		p.OnOption(name, value)
+	}
+}
+
+func (p *Parser) warn(message string) {
+	if p.OnWarning != nil {
+		p.OnWarning(message)
+	}
+}
+
+func isShortOption(arg string) bool {
+	return strings.HasPrefix(arg, "-")
+}
+
+func isLongOption(arg string) bool {
+	return strings.HasPrefix(arg, "--")
+}
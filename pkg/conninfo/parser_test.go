@@ -0,0 +1,392 @@
+package conninfo
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Unsets the variables of libpq and isolates the home directory,
+// so that the service files of the user do not affect the tests
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, entry := range os.Environ() {
+		var name, _, _ = strings.Cut(entry, "=")
+		if strings.HasPrefix(name, "PG") {
+			// Restored after the test
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	var home = t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+}
+
+type parseTest struct {
+	args []string
+	want ConnInfo
+}
+
+// Parses the arguments of the command, and compares the result ignoring the warnings
+func runParseTests(t *testing.T, command string, tests []parseTest) {
+	t.Helper()
+	clearEnv(t)
+	for _, test := range tests {
+		var p = Parser{Command: command}
+		var got, err = p.Parse(test.args)
+		if err != nil {
+			t.Errorf("%s %q: %v", command, test.args, err)
+		} else if got != test.want {
+			t.Errorf("%s %q = %+v, want %+v", command, test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseOptionsOfPgDump(t *testing.T) {
+	runParseTests(t, "pg_dump", []parseTest{
+		{[]string{"-t", "orders", "-U", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{[]string{"-n", "public", "-F", "c", "sales"}, ConnInfo{Dbname: "sales"}},
+		{[]string{"--table", "orders", "--schema=public", "--username", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{[]string{"-Fc", "-Z", "9", "-h", "db.example.com", "sales"}, ConnInfo{Host: "db.example.com", Dbname: "sales"}},
+		{[]string{"-E", "UTF8", "sales"}, ConnInfo{Dbname: "sales"}},
+		{[]string{"--encoding", "UTF8", "--include-foreign-data", "remote", "-U", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		// Only the database is positional unlike psql
+		{[]string{"sales", "alice"}, ConnInfo{Dbname: "sales"}},
+	})
+}
+
+func TestParseOptionsOfPgRestore(t *testing.T) {
+	runParseTests(t, "pg_restore", []parseTest{
+		{[]string{"-d", "sales", "-U", "alice", "sales.dump"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{[]string{"-F", "c", "-L", "list.txt", "-U", "alice", "sales.dump"}, ConnInfo{User: "alice"}},
+		{[]string{"--dbname=sales", "--use-list", "list.txt", "-j", "4", "sales.dump"}, ConnInfo{Dbname: "sales"}},
+	})
+}
+
+func TestParseOptionsOfPsql(t *testing.T) {
+	runParseTests(t, "psql", []parseTest{
+		// -t and -A take no value in psql
+		{[]string{"-t", "-A", "sales", "alice"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{[]string{"-c", "select 1", "-v", "ON_ERROR_STOP=1", "sales"}, ConnInfo{Dbname: "sales"}},
+		{[]string{"-f", "script.sql", "-U", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+	})
+	// Unknown commands are taken as psql
+	runParseTests(t, "", []parseTest{
+		{[]string{"-t", "sales", "alice"}, ConnInfo{User: "alice", Dbname: "sales"}},
+	})
+}
+
+// Returns the parameters parsed from the arguments of psql along with the options notified
+func parseRecordingOptions(t *testing.T, args []string) (ConnInfo, []string) {
+	t.Helper()
+	var options []string
+	var p = Parser{
+		OnOption: func(name string, value string) {
+			options = append(options, name+"="+value)
+		},
+	}
+	var info, err = p.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info, options
+}
+
+func TestParseEndOfOptions(t *testing.T) {
+	clearEnv(t)
+	var tests = []struct {
+		args    []string
+		want    ConnInfo
+		options string
+	}{
+		{[]string{"--", "-U", "notauser", "mydb"}, ConnInfo{Dbname: "-U", User: "notauser"}, ""},
+		{[]string{"-U", "alice", "--", "-Ubob"}, ConnInfo{User: "alice", Dbname: "-Ubob"}, "-U=alice"},
+		{[]string{"sales", "--", "--username=bob"}, ConnInfo{Dbname: "sales", User: "--username=bob"}, ""},
+	}
+	for _, test := range tests {
+		var got, options = parseRecordingOptions(t, test.args)
+		if got != test.want {
+			t.Errorf("%q = %+v, want %+v", test.args, got, test.want)
+		}
+		if strings.Join(options, " ") != test.options {
+			t.Errorf("%q notified %q, want %q", test.args, options, test.options)
+		}
+	}
+}
+
+func TestParseBundledShortOptions(t *testing.T) {
+	clearEnv(t)
+	var tests = []struct {
+		args    []string
+		want    ConnInfo
+		options string
+	}{
+		{[]string{"-tA", "sales"}, ConnInfo{Dbname: "sales"}, "-t= -A="},
+		// Every letter is a flag as none of them takes a value
+		{[]string{"-Awuser", "sales"}, ConnInfo{Dbname: "sales"}, "-A= -w= -u= -s= -e= -r="},
+		{[]string{"-AwUalice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}, "-A= -w= -U=alice"},
+		{[]string{"-tAU", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}, "-t= -A= -U=alice"},
+		{[]string{"-wh", "db.example.com", "sales"}, ConnInfo{Host: "db.example.com", Dbname: "sales"}, "-w= -h=db.example.com"},
+		// The value of -c is never taken as the options
+		{[]string{"-qc", "-U", "sales"}, ConnInfo{Dbname: "sales"}, "-q= -c=-U"},
+	}
+	for _, test := range tests {
+		var got, options = parseRecordingOptions(t, test.args)
+		if got != test.want {
+			t.Errorf("%q = %+v, want %+v", test.args, got, test.want)
+		}
+		if strings.Join(options, " ") != test.options {
+			t.Errorf("%q notified %q, want %q", test.args, options, test.options)
+		}
+	}
+}
+
+func TestParsePositionalDbnameOrConnectionString(t *testing.T) {
+	clearEnv(t)
+	var tests = []struct {
+		arg    string
+		want   ConnInfo
+		source Source
+	}{
+		{"sales", ConnInfo{Dbname: "sales"}, SourceArg},
+		{"sales-2024_q1", ConnInfo{Dbname: "sales-2024_q1"}, SourceArg},
+		{"host=db.example.com user=alice dbname=sales", ConnInfo{User: "alice", Host: "db.example.com", Dbname: "sales"}, SourceConnString},
+		{"dbname=sales", ConnInfo{Dbname: "sales"}, SourceConnString},
+		{"postgresql://alice@db.example.com/sales", ConnInfo{User: "alice", Host: "db.example.com", Dbname: "sales"}, SourceURI},
+	}
+	for _, test := range tests {
+		var p Parser
+		var got, sources, err = p.ParseWithSources([]string{test.arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%q = %+v, want %+v", test.arg, got, test.want)
+		}
+		if sources["dbname"] != test.source {
+			t.Errorf("%q: source of dbname = %q, want %q", test.arg, sources["dbname"], test.source)
+		}
+	}
+}
+
+func TestParseExtraPositionalArgs(t *testing.T) {
+	clearEnv(t)
+	var warnings []string
+	var p = Parser{
+		OnWarning: func(message string) {
+			warnings = append(warnings, message)
+		},
+	}
+	var got, err = p.Parse([]string{"sales", "alice", "extra"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ConnInfo{User: "alice", Dbname: "sales"}); got != want {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+	if len(warnings) != 1 || warnings[0] != "extra command-line argument \"extra\" ignored" {
+		t.Errorf("warnings = %q, want the extra argument", warnings)
+	}
+}
+
+func TestParseDbnameOptionAsConnectionString(t *testing.T) {
+	runParseTests(t, "psql", []parseTest{
+		{[]string{"-d", "host=db.example.com user=alice dbname=sales"}, ConnInfo{User: "alice", Host: "db.example.com", Dbname: "sales"}},
+		{[]string{"--dbname=postgresql://alice@db.example.com/sales"}, ConnInfo{User: "alice", Host: "db.example.com", Dbname: "sales"}},
+		{[]string{"-d", "sales"}, ConnInfo{Dbname: "sales"}},
+		// The options given explicitly win over the connection string
+		{[]string{"-U", "bob", "-d", "postgresql://alice@db.example.com/sales"}, ConnInfo{User: "bob", Host: "db.example.com", Dbname: "sales"}},
+		{[]string{"-d", "user=alice dbname=sales", "-h", "replica.example.com"}, ConnInfo{User: "alice", Host: "replica.example.com", Dbname: "sales"}},
+	})
+}
+
+func TestParseVersionOption(t *testing.T) {
+	runParseTests(t, "psql", []parseTest{
+		{[]string{"-V", "sales"}, ConnInfo{Dbname: "sales"}},
+		{[]string{"--version", "sales", "alice"}, ConnInfo{User: "alice", Dbname: "sales"}},
+	})
+}
+
+func TestParseHelpOption(t *testing.T) {
+	runParseTests(t, "psql", []parseTest{
+		{[]string{"-?", "mydb"}, ConnInfo{Dbname: "mydb"}},
+		{[]string{"-?", "mydb", "alice"}, ConnInfo{User: "alice", Dbname: "mydb"}},
+		{[]string{"--help", "mydb"}, ConnInfo{Dbname: "mydb"}},
+	})
+}
+
+func TestParseValidatesPort(t *testing.T) {
+	clearEnv(t)
+	var tests = []struct {
+		args    []string
+		port    string
+		warning string
+	}{
+		{[]string{"-p", "5432"}, "5432", ""},
+		{[]string{"-p", "1"}, "1", ""},
+		{[]string{"-p", "65535"}, "65535", ""},
+		{[]string{"host=db1,db2 port=5432,6432"}, "5432,6432", ""},
+		{[]string{"-p", "0"}, "", "invalid port \"0\" ignored"},
+		{[]string{"-p", "65536"}, "", "invalid port \"65536\" ignored"},
+		{[]string{"port=abc"}, "", "invalid port \"abc\" ignored"},
+		{[]string{"-p", "+5432"}, "", "invalid port \"+5432\" ignored"},
+		{[]string{"postgresql://db.example.com:99999/sales"}, "", "invalid port \"99999\" ignored"},
+	}
+	for _, test := range tests {
+		var warnings []string
+		var p = Parser{
+			OnWarning: func(message string) {
+				warnings = append(warnings, message)
+			},
+		}
+		var info, sources, err = p.ParseWithSources(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Port != test.port {
+			t.Errorf("port of %q = %q, want %q", test.args, info.Port, test.port)
+		}
+		if _, found := sources["port"]; found != (test.port != "") {
+			t.Errorf("source of the port of %q = %q", test.args, sources["port"])
+		}
+		if strings.Join(warnings, "\n") != test.warning {
+			t.Errorf("warnings of %q = %q, want %q", test.args, warnings, test.warning)
+		}
+	}
+}
+
+func TestParseCustomUserOption(t *testing.T) {
+	clearEnv(t)
+	var tests = []struct {
+		option string
+		args   []string
+		want   ConnInfo
+	}{
+		{"--connect-user", []string{"--connect-user", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{"--connect-user", []string{"--connect-user=alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		// Given explicitly, so the positional one is not taken as the user
+		{"--connect-user", []string{"--connect-user=", "sales", "bob"}, ConnInfo{Dbname: "sales"}},
+		{"--connect-user", []string{"-U", "bob", "--connect-user", "alice"}, ConnInfo{User: "alice"}},
+		{"-u", []string{"-u", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{"-u", []string{"-tualice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		// Unknown without the option
+		{"", []string{"--connect-user", "alice", "sales"}, ConnInfo{User: "sales", Dbname: "alice"}},
+	}
+	for _, test := range tests {
+		var p = Parser{UserOption: test.option}
+		var got, sources, err = p.ParseWithSources(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%q with %q = %+v, want %+v", test.args, test.option, got, test.want)
+		}
+		if got.User != "" && test.option != "" && sources["user"] != SourceArg {
+			t.Errorf("%q: source of user = %q, want %q", test.args, sources["user"], SourceArg)
+		}
+	}
+}
+
+func TestParseUserOptionFollowedByOption(t *testing.T) {
+	clearEnv(t)
+	var tests = []struct {
+		args    []string
+		want    ConnInfo
+		options string
+		warning string
+	}{
+		{[]string{"-U", "-W", "sales"}, ConnInfo{Dbname: "sales"}, "-W=",
+			"missing value for option \"-U\", \"-W\" is not taken as the username"},
+		{[]string{"-U", "--verbose", "sales"}, ConnInfo{Dbname: "sales"}, "--verbose=",
+			"missing value for option \"-U\", \"--verbose\" is not taken as the username"},
+		{[]string{"--username", "-W", "sales", "alice"}, ConnInfo{Dbname: "sales", User: "alice"}, "-W=",
+			"missing value for option \"--username\", \"-W\" is not taken as the username"},
+		{[]string{"sales", "-U"}, ConnInfo{Dbname: "sales"}, "", "missing value for option \"-U\""},
+		// A single dash is a value
+		{[]string{"-U", "-", "sales"}, ConnInfo{User: "-", Dbname: "sales"}, "-U=-", ""},
+		// So is the one attached to the option
+		{[]string{"-U-W", "sales"}, ConnInfo{User: "-W", Dbname: "sales"}, "-U=-W", ""},
+		{[]string{"--username=--verbose", "sales"}, ConnInfo{User: "--verbose", Dbname: "sales"}, "--username=--verbose", ""},
+	}
+	for _, test := range tests {
+		var options, warnings []string
+		var p = Parser{
+			OnOption: func(name string, value string) {
+				options = append(options, name+"="+value)
+			},
+			OnWarning: func(message string) {
+				warnings = append(warnings, message)
+			},
+		}
+		var got, err = p.Parse(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%q = %+v, want %+v", test.args, got, test.want)
+		}
+		if strings.Join(options, " ") != test.options {
+			t.Errorf("%q notified %q, want %q", test.args, options, test.options)
+		}
+		if strings.Join(warnings, "\n") != test.warning {
+			t.Errorf("warnings of %q = %q, want %q", test.args, warnings, test.warning)
+		}
+	}
+}
+
+func TestParseOptionsOfPgDumpall(t *testing.T) {
+	runParseTests(t, "pg_dumpall", []parseTest{
+		{[]string{"-f", "all.sql", "-U", "alice", "-h", "db.example.com", "-p", "6432"}, ConnInfo{User: "alice", Host: "db.example.com", Port: "6432"}},
+		{[]string{"-S", "postgres", "-E", "UTF8", "--exclude-database", "tmp*", "-U", "alice"}, ConnInfo{User: "alice"}},
+		{[]string{"-g", "-c", "-d", "host=db.example.com user=alice"}, ConnInfo{User: "alice", Host: "db.example.com"}},
+		{[]string{"--roles-only", "--dbname=postgresql://alice@db.example.com/postgres"}, ConnInfo{User: "alice", Host: "db.example.com", Dbname: "postgres"}},
+		// No positional arguments are connection parameters
+		{[]string{"-U", "alice", "extra"}, ConnInfo{User: "alice"}},
+	})
+}
+
+func TestParseOptionsOfVacuumdb(t *testing.T) {
+	runParseTests(t, "vacuumdb", []parseTest{
+		{[]string{"-z", "-t", "orders", "-U", "alice", "sales"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{[]string{"-j", "4", "-n", "public", "-P", "2", "-d", "sales", "-U", "alice"}, ConnInfo{User: "alice", Dbname: "sales"}},
+		{[]string{"--analyze-only", "--buffer-usage-limit", "256kB", "--maintenance-db=sales", "-h", "db.example.com"}, ConnInfo{Host: "db.example.com", Dbname: "sales"}},
+		{[]string{"-a", "-U", "alice"}, ConnInfo{User: "alice"}},
+	})
+}
+
+func TestParseOptionsOfCreatedb(t *testing.T) {
+	runParseTests(t, "createdb", []parseTest{
+		{[]string{"-O", "bob", "-T", "template0", "-U", "alice", "newdb"}, ConnInfo{User: "alice"}},
+		{[]string{"-E", "UTF8", "-l", "C", "-D", "fast", "-h", "db.example.com", "newdb", "the new one"}, ConnInfo{Host: "db.example.com"}},
+		{[]string{"--maintenance-db", "template1", "--username=alice", "newdb"}, ConnInfo{User: "alice", Dbname: "template1"}},
+		// -e echoes the commands, taking no value
+		{[]string{"-e", "-U", "alice", "newdb"}, ConnInfo{User: "alice"}},
+	})
+}
+
+func TestParseOptionsOfDropdb(t *testing.T) {
+	runParseTests(t, "dropdb", []parseTest{
+		{[]string{"-i", "-e", "-U", "alice", "olddb"}, ConnInfo{User: "alice"}},
+		{[]string{"--if-exists", "-f", "-h", "db.example.com", "-p", "6432", "olddb"}, ConnInfo{Host: "db.example.com", Port: "6432"}},
+		{[]string{"--maintenance-db=postgres", "-U", "alice", "olddb"}, ConnInfo{User: "alice", Dbname: "postgres"}},
+	})
+}
+
+func TestParseEncodingOfPgDump(t *testing.T) {
+	clearEnv(t)
+	var warnings []string
+	var p = Parser{
+		Command: "pg_dump",
+		OnWarning: func(message string) {
+			warnings = append(warnings, message)
+		},
+	}
+	var info, err = p.Parse([]string{"-E", "UTF8", "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != (ConnInfo{Dbname: "sales"}) || len(warnings) != 0 {
+		t.Errorf("parsed %+v with warnings %q, want the dbname \"sales\" only", info, warnings)
+	}
+}
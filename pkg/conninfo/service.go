@@ -0,0 +1,96 @@
+package conninfo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the connection service files in the order to be searched
+func serviceFiles() []string {
+	var files []string
+	if path := os.Getenv("PGSERVICEFILE"); path != "" {
+		files = append(files, path)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "pg_service.conf"))
+	}
+	return files
+}
+
+// Searches the service files for the parameters of the service.
+// A service referring to another one by the keyword "service" inherits its parameters.
+// Missing files are skipped silently.
+func searchServiceFiles(service string) (ConnInfo, error) {
+	var info ConnInfo
+	var visited = make(map[string]bool)
+	for service != "" {
+		if visited[service] {
+			return ConnInfo{}, fmt.Errorf("service \"%s\" is referred to cyclically", service)
+		}
+		visited[service] = true
+		var found, err = findService(service)
+		if err != nil {
+			return ConnInfo{}, err
+		}
+		service, found.Service = found.Service, ""
+		info, _ = combineLayers([]layer{{SourceService, info}, {SourceService, found}})
+	}
+	return info, nil
+}
+
+// Returns the parameters of the service in the first service file defining it
+func findService(service string) (ConnInfo, error) {
+	for _, path := range serviceFiles() {
+		var info, found, err = readServiceFile(path, service)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return ConnInfo{}, err
+		}
+		if found {
+			return info, nil
+		}
+	}
+	return ConnInfo{}, nil
+}
+
+// Reads the parameters in the section of the service from the file
+func readServiceFile(path string, service string) (ConnInfo, bool, error) {
+	var info ConnInfo
+	var file, err = os.Open(path)
+	if err != nil {
+		return info, false, err
+	}
+	defer file.Close()
+
+	var found, inSection bool
+	var scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if found {
+				break
+			}
+			inSection = line[1:len(line)-1] == service
+			found = inSection
+			continue
+		}
+		if inSection {
+			if key, value, ok := strings.Cut(line, "="); ok {
+				info.set(strings.TrimSpace(key), strings.TrimSpace(value))
+			}
+		}
+	}
+	return info, found, scanner.Err()
+}
@@ -0,0 +1,96 @@
+package conninfo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes the connection service file given by PGSERVICEFILE
+func writeServiceFile(t *testing.T, content string) {
+	t.Helper()
+	var path = filepath.Join(t.TempDir(), "pg_service.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PGSERVICEFILE", path)
+}
+
+const testServiceFile = `# services for the tests
+[analytics]
+host=analytics.example.com
+user = reporter
+dbname=warehouse
+
+[sales]
+host=sales.example.com
+`
+
+func TestParseWithPGSERVICE(t *testing.T) {
+	clearEnv(t)
+	writeServiceFile(t, testServiceFile)
+	t.Setenv("PGSERVICE", "analytics")
+
+	var p Parser
+	var info, sources, err = p.ParseWithSources([]string{"-h", "replica.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = ConnInfo{User: "reporter", Host: "replica.example.com", Dbname: "warehouse", Service: "analytics"}
+	if info != want {
+		t.Errorf("parsed %+v, want %+v", info, want)
+	}
+	if sources["user"] != SourceService || sources["service"] != SourceEnv || sources["host"] != SourceArg {
+		t.Errorf("sources = %v", sources)
+	}
+
+	// The service in the arguments wins over PGSERVICE
+	info, err = p.Parse([]string{"service=sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ConnInfo{Host: "sales.example.com", Service: "sales"}); info != want {
+		t.Errorf("parsed %+v, want %+v", info, want)
+	}
+}
+
+func TestParseChainedServices(t *testing.T) {
+	clearEnv(t)
+	writeServiceFile(t, `[reporting]
+service=analytics
+user=reporter
+
+[analytics]
+service=base
+dbname=warehouse
+user=analyst
+
+[base]
+host=analytics.example.com
+port=6432
+dbname=postgres
+
+[loop]
+service=back
+
+[back]
+service=loop
+`)
+	var p Parser
+	var info, sources, err = p.ParseWithSources([]string{"service=reporting"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The service referring to another wins over it
+	var want = ConnInfo{User: "reporter", Host: "analytics.example.com", Port: "6432", Dbname: "warehouse", Service: "reporting"}
+	if info != want {
+		t.Errorf("parsed %+v, want %+v", info, want)
+	}
+	if sources["host"] != SourceService || sources["service"] != SourceConnString {
+		t.Errorf("sources = %v", sources)
+	}
+
+	if _, err := p.Parse([]string{"service=loop"}); err == nil || err.Error() != "service \"loop\" is referred to cyclically" {
+		t.Errorf("error = %v, want the cycle", err)
+	}
+}
@@ -0,0 +1,92 @@
+package conninfo
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Parses the connection URI which the url package cannot handle,
+// e.g. the one containing an invalid percent-encoding or multiple hosts.
+func parseURILeniently(uri string) ConnInfo {
+	var info ConnInfo
+
+	var _, rest, found = strings.Cut(uri, "://")
+	if !found {
+		return info
+	}
+
+	var authority = rest
+	var path string
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		authority, path = rest[:i], rest[i:]
+	}
+
+	var hostport = authority
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		var userinfo = authority[:i]
+		hostport = authority[i+1:]
+		var user, _, _ = strings.Cut(userinfo, ":")
+		info.User = unescapeURIComponent(user)
+	}
+
+	// Multiple hosts are represented as comma-separated lists like in a connection string
+	var hosts, ports []string
+	for _, spec := range strings.Split(hostport, ",") {
+		var host, port = splitHostPort(spec)
+		hosts = append(hosts, unescapeURIComponent(host))
+		ports = append(ports, port)
+	}
+	info.Host = strings.Join(hosts, ",")
+	if strings.Join(ports, "") != "" {
+		info.Port = strings.Join(ports, ",")
+	}
+
+	var dbname, query, _ = strings.Cut(path, "?")
+	info.Dbname = unescapeURIComponent(strings.TrimPrefix(dbname, "/"))
+	if values, err := url.ParseQuery(query); err == nil {
+		setQueryParams(&info, values)
+	}
+
+	return info
+}
+
+// Splits the host and the optional port, where an IPv6 address is enclosed in brackets, e.g. [::1]:5432
+func splitHostPort(spec string) (string, string) {
+	if strings.HasPrefix(spec, "[") {
+		if i := strings.Index(spec, "]"); i >= 0 {
+			var port, _ = strings.CutPrefix(spec[i+1:], ":")
+			return spec[1:i], port
+		}
+	}
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// Keywords of the parameters which are taken from the query of the URI
+var queryKeywords = []string{"host", "port", "service", "sslmode", "options", "passfile"}
+
+func setQueryParams(info *ConnInfo, values url.Values) {
+	for _, keyword := range queryKeywords {
+		if value := values.Get(keyword); value != "" {
+			info.set(keyword, value)
+		}
+	}
+	// The user in the query is taken only if the userinfo is absent
+	if info.User == "" {
+		info.User = values.Get("user")
+	}
+	// So is the database in the query only if the path is empty
+	if info.Dbname == "" {
+		info.Dbname = values.Get("dbname")
+	}
+}
+
+// Decodes the component, or returns it as is if it is not decodable
+func unescapeURIComponent(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}